@@ -0,0 +1,229 @@
+package vufs
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/lionkov/go9p/p"
+)
+
+// An ACLEntry gives a user, or the members of a group, permissions on
+// a file that its mode doesn't, or takes away ones that it does.  A
+// file's entries are checked after its mode (see checkPerm), and a
+// deny beats an allow.
+type ACLEntry struct {
+	// Id is a group's, rather than a user's.
+	Group bool
+	Id    int
+	// Take Perm away rather than grant it.
+	Deny bool
+	// Some of DMREAD, DMWRITE and DMEXEC.
+	Perm uint32
+}
+
+// As written in a Meta field (u3+rx) or, with name for the id, in a
+// ctl command (u:moe+rx).
+func (e ACLEntry) format(name string) string {
+	kind, sign := "u", "+"
+	if e.Group {
+		kind = "g"
+	}
+	if e.Deny {
+		sign = "-"
+	}
+	perm := ""
+	for i, c := range "rwx" {
+		if e.Perm&(p.DMREAD>>uint(i)) != 0 {
+			perm += string(c)
+		}
+	}
+	return kind + name + sign + perm
+}
+
+func (e ACLEntry) String() string {
+	return e.format(strconv.Itoa(e.Id))
+}
+
+// Parse an entry written by format; lookup turns the name into an id.
+func parseACLEntry(s string, lookup func(group bool, name string) (int, error)) (ACLEntry, error) {
+	var e ACLEntry
+	i := strings.LastIndexAny(s, "+-")
+	if i < 2 || (s[0] != 'u' && s[0] != 'g') || i == len(s)-1 {
+		return e, fmt.Errorf("bad ACL entry '%s'", s)
+	}
+	e.Group = s[0] == 'g'
+	e.Deny = s[i] == '-'
+	for _, c := range s[i+1:] {
+		switch c {
+		case 'r':
+			e.Perm |= p.DMREAD
+		case 'w':
+			e.Perm |= p.DMWRITE
+		case 'x':
+			e.Perm |= p.DMEXEC
+		default:
+			return e, fmt.Errorf("bad ACL entry '%s'", s)
+		}
+	}
+	var err error
+	e.Id, err = lookup(e.Group, s[1:i])
+	return e, err
+}
+
+// The ACL in a Meta field: entries separated by commas.
+func parseACL(s string) ([]ACLEntry, error) {
+	acl := make([]ACLEntry, 0)
+	for _, f := range strings.Split(s, ",") {
+		e, err := parseACLEntry(f, func(group bool, id string) (int, error) {
+			return strconv.Atoi(id)
+		})
+		if err != nil {
+			return nil, err
+		}
+		acl = append(acl, e)
+	}
+	return acl, nil
+}
+
+func formatACL(acl []ACLEntry) string {
+	entries := make([]string, len(acl))
+	for i, e := range acl {
+		entries[i] = e.String()
+	}
+	return strings.Join(entries, ",")
+}
+
+// The permissions that acl grants user, and those it takes away.
+func aclPerms(acl []ACLEntry, user p.User) (allow, deny uint32) {
+	// As with the mode, none's groups don't count.
+	var groups []p.Group
+	if user.Name() != noneUser {
+		groups = allGroups(user)
+	}
+	for _, e := range acl {
+		match := !e.Group && e.Id == user.Id()
+		for i := 0; e.Group && !match && i < len(groups); i++ {
+			match = groups[i].Id() == e.Id
+		}
+		switch {
+		case match && e.Deny:
+			deny |= e.Perm
+		case match:
+			allow |= e.Perm
+		}
+	}
+	return allow, deny
+}
+
+// The ACL of path, or nil.  The root has none.
+func (u *VuFs) acl(path string) []ACLEntry {
+	if u.isRoot(path) {
+		return nil
+	}
+	m, found, err := u.meta().Get(path, nil)
+	if err != nil || !found {
+		return nil
+	}
+	return m.ACL
+}
+
+// CheckPerm for the file at path, whose Dir is f, and then the file's
+// ACL, if it has one.
+func (u *VuFs) checkPerm(path string, f *p.Dir, user p.User, perm uint32) bool {
+
+	acl := u.acl(path)
+	if len(acl) == 0 || user == nil || isDisabled(user) {
+		return CheckPerm(f, user, perm)
+	}
+
+	var granted uint32
+	for _, bit := range []uint32{p.DMREAD, p.DMWRITE, p.DMEXEC} {
+		if CheckPerm(f, user, bit) {
+			granted |= bit
+		}
+	}
+	allow, deny := aclPerms(acl, user)
+
+	return perm&7&^((granted|allow)&^deny) == 0
+}
+
+// The ACL of a file as ctl command arguments: u:name+perm and so on.
+func (u *VuFs) ctlACL(acl []ACLEntry) []string {
+	args := make([]string, len(acl))
+	for i, e := range acl {
+		name := strconv.Itoa(e.Id)
+		if e.Group {
+			if g := u.Upool.Gid2Group(e.Id); g != nil {
+				name = g.Name()
+			}
+		} else if user := u.Upool.Uid2User(e.Id); user != nil {
+			name = user.Name()
+		}
+		args[i] = e.format(":" + name)
+	}
+	return args
+}
+
+// The contents of adm/acl: each file under the root that has an ACL,
+// as the arguments of the ctl command that would set it.
+func readACLs(u *VuFs) []byte {
+	var buf bytes.Buffer
+	filepath.Walk(u.Root, func(path string, st os.FileInfo, err error) error {
+		if err != nil || u.isMetaFile(path) {
+			return nil
+		}
+		if acl := u.acl(path); len(acl) > 0 {
+			rel, _ := filepath.Rel(u.Root, path)
+			fmt.Fprintf(&buf, "/%s %s\n", rel, strings.Join(u.ctlACL(acl), " "))
+		}
+		return nil
+	})
+	return buf.Bytes()
+}
+
+// acl path [u:name+perm | u:name-perm | g:name+perm | g:name-perm ...]
+func ctlSetACL(u *VuFs, args []string) error {
+	if len(args) < 1 {
+		return Ebadctl
+	}
+	path := filepath.Join(u.Root, filepath.Clean("/"+args[0]))
+	if u.isMetaFile(path) {
+		return Ebadctl
+	}
+	st, err := os.Stat(path)
+	if err != nil {
+		return toError(err)
+	}
+
+	var acl []ACLEntry
+	for _, arg := range args[1:] {
+		e, err := parseACLEntry(arg, func(group bool, name string) (int, error) {
+			if !strings.HasPrefix(name, ":") {
+				return 0, Ebadctl
+			}
+			name = name[1:]
+			if group {
+				if g := u.Upool.Gname2Group(name); g != nil {
+					return g.Id(), nil
+				}
+				return 0, fmt.Errorf("no group '%s'", name)
+			}
+			if user := u.Upool.Uname2User(name); user != nil {
+				return user.Id(), nil
+			}
+			return 0, fmt.Errorf("no user '%s'", name)
+		})
+		if err != nil {
+			return err
+		}
+		acl = append(acl, e)
+	}
+
+	unlock := u.dirs.lock(filepath.Dir(path))
+	defer unlock()
+	return u.changeMeta(path, st, u.Upool, func(m *Meta) { m.ACL = acl })
+}
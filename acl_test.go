@@ -0,0 +1,108 @@
+package vufs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lionkov/go9p/p"
+)
+
+func TestACL(t *testing.T) {
+
+	root, _ := scratchRoot(t)
+	defer os.RemoveAll(root)
+
+	// none and mark are in group nuts.
+	err := ioutil.WriteFile(filepath.Join(root, usersFile), []byte("1:adm:\n2:mark:nuts\n3:nuts:\n4:none:nuts\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := NewVusers(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := &VuFs{Root: root}
+	fs.Upool = users
+	adm := users.Uname2User("adm")
+	a := filepath.Join(root, "a")
+	os.Chmod(a, 0640)
+	fs.meta().Set(a, nil, Meta{Uid: 3, Gid: 3, Muid: 3})
+
+	for _, bad := range []string{
+		"acl",
+		"acl /a u:nobody+r",
+		"acl /a x:mark+r",
+		"acl /a u:mark+q",
+		"acl /a u:mark",
+		"acl /a umark+r",
+		"acl /nothere u:mark+r",
+	} {
+		if err := writeCtl(fs, adm, []byte(bad)); err == nil {
+			t.Errorf("ctl accepted '%s'\n", bad)
+		}
+	}
+
+	tests := []struct {
+		acl     string
+		user    string
+		perm    uint32
+		allowed bool
+	}{
+		{"", "adm", p.DMREAD, false},
+		{"u:adm+r", "adm", p.DMREAD, true},
+		{"u:adm+r", "adm", p.DMWRITE, false},
+		{"u:adm+rw", "adm", p.DMREAD | p.DMWRITE, true},
+		{"", "mark", p.DMREAD, true},
+		{"g:nuts-r", "mark", p.DMREAD, false},
+		{"g:nuts+x", "mark", p.DMEXEC, true},
+		// Deny beats allow.
+		{"u:mark+r u:mark-r", "mark", p.DMREAD, false},
+		{"u:mark-r u:mark+r", "mark", p.DMREAD, false},
+		// none's groups don't count.
+		{"g:nuts+r", "none", p.DMREAD, false},
+		{"u:none+r", "none", p.DMREAD, true},
+	}
+
+	for _, tt := range tests {
+		if err := writeCtl(fs, adm, []byte("acl /a "+tt.acl)); err != nil {
+			t.Fatalf("acl /a %s: %v\n", tt.acl, err)
+		}
+		st, _ := os.Stat(a)
+		f, err := fs.dir2Dir(a, st, users)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fs.checkPerm(a, f, users.Uname2User(tt.user), tt.perm) != tt.allowed {
+			t.Errorf("acl '%s': %s allowed %#o is not %v\n", tt.acl, tt.user, tt.perm, tt.allowed)
+		}
+	}
+
+	// Reread from disk.
+	fs.uidgids = uidgidStore{}
+	writeCtl(fs, adm, []byte("acl /a u:adm+rw g:nuts-x\n"))
+	if data := string(readACLs(fs)); data != "/a u:adm+rw g:nuts-x\n" {
+		t.Errorf("adm/acl is '%s', expected '/a u:adm+rw g:nuts-x'\n", data)
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(root, uidgidFile))
+	if string(data) != "a:3:3:3:0x0:acl=u1+rw,g3-x\n" {
+		t.Errorf("%s is '%s'\n", uidgidFile, data)
+	}
+
+	writeCtl(fs, adm, []byte("acl /a"))
+	if data := readACLs(fs); len(data) != 0 {
+		t.Errorf("adm/acl is '%s' after removing the ACL\n", data)
+	}
+}
+
+// Listing adm/ doesn't make the synthetic files' contents (adm/acl
+// walks the whole tree).
+func TestSynthDirLength(t *testing.T) {
+	for _, sf := range synthFiles {
+		if d := sf.dir(); d.Length != 0 {
+			t.Errorf("adm/%s has length %d, not 0\n", sf.name, d.Length)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package vufs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/lionkov/go9p/p/srv"
+)
+
+// DirDefaults are what a directory gives the files created in it,
+// whatever the client asked for, so that a tree shared by a group
+// stays usable by the group.  A directory created in the directory
+// gets the same defaults.
+type DirDefaults struct {
+	// The group of new files, or NoGid for the directory's group.
+	Gid int
+	// The permissions new files may have; the rest are cleared.
+	Mask uint32
+	// The bits new files always get: permissions, and any of the
+	// mode bits vufs keeps (DMAPPEND, DMTMP and so on).
+	Force uint32
+}
+
+// For a DirDefaults that leaves the group alone.
+const NoGid = -1
+
+// As written in a Meta field: gid,mask,force.
+func (d *DirDefaults) String() string {
+	return fmt.Sprintf("%d,%#o,%#o", d.Gid, d.Mask, d.Force)
+}
+
+func parseDirDefaults(s string) (*DirDefaults, error) {
+	fields := strings.Split(s, ",")
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("bad defaults '%s'", s)
+	}
+	gid, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	mask, err := strconv.ParseUint(fields[1], 0, 32)
+	if err != nil {
+		return nil, err
+	}
+	force, err := strconv.ParseUint(fields[2], 0, 32)
+	if err != nil {
+		return nil, err
+	}
+	d := &DirDefaults{Gid: gid, Mask: uint32(mask), Force: uint32(force)}
+	return d, d.check()
+}
+
+func (d *DirDefaults) check() error {
+	if d.Mask&^0777 != 0 {
+		return fmt.Errorf("mask %#o has more than permissions", d.Mask)
+	}
+	if d.Force&^(0777|metaModeBits) != 0 {
+		return fmt.Errorf("can't force bits %#o", d.Force&^(0777|metaModeBits))
+	}
+	return nil
+}
+
+// The permissions of a file created with perm.
+func (d *DirDefaults) perm(perm uint32) uint32 {
+	return perm&^0777 | perm&d.Mask | d.Force
+}
+
+// The defaults of the directory dir, or nil if it has none.
+func (u *VuFs) dirDefaults(dir string) *DirDefaults {
+	if u.isRoot(dir) {
+		return nil
+	}
+	m, found, err := u.meta().Get(dir, nil)
+	if err != nil || !found {
+		return nil
+	}
+	return m.Defaults
+}
+
+// The host path of the directory named (relative to the root) in a
+// ctl command.
+func (u *VuFs) ctlDir(name string) (string, os.FileInfo, error) {
+	path := filepath.Join(u.Root, filepath.Clean("/"+name))
+	if u.isMetaFile(path) {
+		return "", nil, srv.Eperm
+	}
+	st, err := os.Stat(path)
+	if err != nil {
+		return "", nil, toError(err)
+	}
+	if !st.IsDir() {
+		return "", nil, srv.Enotdir
+	}
+	return path, st, nil
+}
+
+// Set or clear the defaults of the directory name.
+func (u *VuFs) setDirDefaults(name string, d *DirDefaults) error {
+	path, st, err := u.ctlDir(name)
+	if err != nil {
+		return err
+	}
+	unlock := u.dirs.lock(filepath.Dir(path))
+	defer unlock()
+	return u.changeMeta(path, st, u.Upool, func(m *Meta) { m.Defaults = d })
+}
+
+// defaults dir [group=name] [mask=perm] [force=perm]
+func ctlDefaults(u *VuFs, args []string) error {
+	if len(args) < 1 {
+		return Ebadctl
+	}
+	d := &DirDefaults{Gid: NoGid, Mask: 0777}
+	for _, arg := range args[1:] {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			return Ebadctl
+		}
+		var err error
+		var n uint64
+		switch kv[0] {
+		case "group":
+			g := u.Upool.Gname2Group(kv[1])
+			if g == nil {
+				return fmt.Errorf("no group '%s'", kv[1])
+			}
+			d.Gid = g.Id()
+		case "mask":
+			n, err = strconv.ParseUint(kv[1], 8, 32)
+			d.Mask = uint32(n)
+		case "force":
+			n, err = strconv.ParseUint(kv[1], 8, 32)
+			d.Force = uint32(n)
+		default:
+			return Ebadctl
+		}
+		if err != nil {
+			return Ebadctl
+		}
+	}
+	if err := d.check(); err != nil {
+		return err
+	}
+	return u.setDirDefaults(args[0], d)
+}
+
+// nodefaults dir
+func ctlNoDefaults(u *VuFs, args []string) error {
+	if len(args) != 1 {
+		return Ebadctl
+	}
+	return u.setDirDefaults(args[0], nil)
+}
@@ -0,0 +1,63 @@
+package vufs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDirDefaults(t *testing.T) {
+
+	root, users := scratchRoot(t)
+	defer os.RemoveAll(root)
+
+	proj := filepath.Join(root, "proj")
+	if err := os.Mkdir(proj, 0755); err != nil {
+		t.Fatal(err)
+	}
+	fs := &VuFs{Root: root}
+	fs.Upool = users
+	adm := users.Uname2User("adm")
+
+	for _, bad := range []string{
+		"defaults",
+		"defaults /a",
+		"defaults /",
+		"defaults /proj group=nobody",
+		"defaults /proj mask=1777",
+		"defaults /proj mask=rw",
+		"defaults /proj color=red",
+		"nodefaults",
+	} {
+		if err := writeCtl(fs, adm, []byte(bad)); err == nil {
+			t.Errorf("ctl accepted '%s'\n", bad)
+		}
+	}
+
+	err := writeCtl(fs, adm, []byte("defaults proj group=nuts mask=0770 force=060\n"))
+	if err != nil {
+		t.Fatalf("defaults proj: %v\n", err)
+	}
+
+	// Reread from disk.
+	fs.uidgids = uidgidStore{}
+	d := fs.dirDefaults(proj)
+	if d == nil || *d != (DirDefaults{3, 0770, 060}) {
+		t.Fatalf("defaults of proj are %v, expected 3,0770,060\n", d)
+	}
+	if perm := d.perm(0644); perm != 0660 {
+		t.Errorf("perm(0644) is %#o, expected 0660\n", perm)
+	}
+	// proj didn't have an owner, and gets the one it had.
+	user, group, err := fs.path2UserGroup(proj, nil, users)
+	if err != nil || user != "adm" || group != "adm" {
+		t.Errorf("owner of proj: %s, %s, %v; expected adm, adm\n", user, group, err)
+	}
+
+	if err = writeCtl(fs, adm, []byte("nodefaults /proj")); err != nil {
+		t.Fatalf("nodefaults /proj: %v\n", err)
+	}
+	if d = fs.dirDefaults(proj); d != nil {
+		t.Errorf("proj still has defaults %v\n", d)
+	}
+}
@@ -0,0 +1,75 @@
+package vufs
+
+import (
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// The ownership of the files in a directory is read, changed and
+// written back whole, so changes to one directory must not overlap,
+// whichever connection they come from.  dirLocks hands out one lock
+// per directory (or, for VuFs.files, per file) for the whole server;
+// a lock is dropped from the table when nobody holds or waits for it.
+type dirLocks struct {
+	sync.Mutex
+	locks map[string]*dirLock
+}
+
+type dirLock struct {
+	sync.Mutex
+	// Holders plus waiters.
+	refs int
+}
+
+// Lock the directories and return a func that unlocks them.  They are
+// always locked in the same (sorted) order, so a rename from one
+// directory to another can't deadlock with one going the other way.
+func (dl *dirLocks) lock(dirs ...string) func() {
+
+	names := make([]string, 0, len(dirs))
+	for _, dir := range dirs {
+		dir = filepath.Clean(dir)
+		if !containsString(names, dir) {
+			names = append(names, dir)
+		}
+	}
+	sort.Strings(names)
+
+	held := make([]*dirLock, len(names))
+	for i, name := range names {
+		held[i] = dl.ref(name)
+		held[i].Lock()
+	}
+
+	return func() {
+		for i := len(held) - 1; i >= 0; i-- {
+			held[i].Unlock()
+			dl.unref(names[i], held[i])
+		}
+	}
+}
+
+func (dl *dirLocks) ref(name string) *dirLock {
+	dl.Lock()
+	defer dl.Unlock()
+	if dl.locks == nil {
+		dl.locks = make(map[string]*dirLock)
+	}
+	l, found := dl.locks[name]
+	if !found {
+		l = new(dirLock)
+		dl.locks[name] = l
+	}
+	l.refs++
+	return l
+}
+
+func (dl *dirLocks) unref(name string, l *dirLock) {
+	dl.Lock()
+	defer dl.Unlock()
+	l.refs--
+	if l.refs == 0 {
+		delete(dl.locks, name)
+	}
+}
@@ -0,0 +1,59 @@
+package vufs
+
+import (
+	"path/filepath"
+
+	"github.com/lionkov/go9p/p"
+)
+
+// True if, in the directory dir, user only sees their own files: dir
+// is a drop box (its Meta has Dropbox set), and user neither owns it
+// nor is an administrator.  Others' files are left out of listings of
+// dir and can't be walked to, so whatever their permissions, user
+// can't read, change or remove them.  The root is never a drop box.
+func (u *VuFs) onlyOwn(dir string, user p.User, upool p.Users) bool {
+
+	if u.isRoot(dir) || isAdmin(user, upool) {
+		return false
+	}
+	m, found, err := u.meta().Get(dir, nil)
+	if err != nil || !found || !m.Dropbox {
+		return false
+	}
+
+	owner, _, err := u.path2UserGroup(dir, nil, upool)
+	return err != nil || owner != user.Name()
+}
+
+// True if user owns path.
+func (u *VuFs) owns(user p.User, path string, upool p.Users) bool {
+	owner, _, err := u.path2UserGroup(path, nil, upool)
+	return err == nil && owner == user.Name()
+}
+
+// Make the directory name a drop box, or an ordinary directory.
+func (u *VuFs) setDropbox(name string, dropbox bool) error {
+	path, st, err := u.ctlDir(name)
+	if err != nil {
+		return err
+	}
+	unlock := u.dirs.lock(filepath.Dir(path))
+	defer unlock()
+	return u.changeMeta(path, st, u.Upool, func(m *Meta) { m.Dropbox = dropbox })
+}
+
+// dropbox dir
+func ctlDropbox(u *VuFs, args []string) error {
+	if len(args) != 1 {
+		return Ebadctl
+	}
+	return u.setDropbox(args[0], true)
+}
+
+// nodropbox dir
+func ctlNoDropbox(u *VuFs, args []string) error {
+	if len(args) != 1 {
+		return Ebadctl
+	}
+	return u.setDropbox(args[0], false)
+}
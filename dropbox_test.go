@@ -0,0 +1,61 @@
+package vufs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDropbox(t *testing.T) {
+
+	root, users := scratchRoot(t)
+	defer os.RemoveAll(root)
+
+	// mark owns box.
+	box := filepath.Join(root, "box")
+	os.Mkdir(box, 0777)
+	fs := &VuFs{Root: root}
+	fs.Upool = users
+	fs.meta().Set(box, nil, Meta{Uid: 2, Gid: 2, Muid: 2})
+
+	adm := users.Uname2User("adm")
+	for _, bad := range []string{"dropbox", "dropbox /a", "dropbox /", "nodropbox"} {
+		if err := writeCtl(fs, adm, []byte(bad)); err == nil {
+			t.Errorf("ctl accepted '%s'\n", bad)
+		}
+	}
+
+	if fs.onlyOwn(box, users.Uname2User("nuts"), users) {
+		t.Error("box is a drop box before it was made one")
+	}
+	if err := writeCtl(fs, adm, []byte("dropbox /box")); err != nil {
+		t.Fatalf("dropbox /box: %v\n", err)
+	}
+
+	tests := []struct {
+		user    string
+		onlyOwn bool
+	}{
+		{"nuts", true},
+		{"mark", false},
+		{"adm", false},
+	}
+	for _, tt := range tests {
+		if fs.onlyOwn(box, users.Uname2User(tt.user), users) != tt.onlyOwn {
+			t.Errorf("%s only sees their own files in box is not %v\n", tt.user, tt.onlyOwn)
+		}
+	}
+
+	data, _ := ioutil.ReadFile(filepath.Join(root, uidgidFile))
+	if string(data) != "box:2:2:2:0x0:dropbox=true\n" {
+		t.Errorf("%s is '%s'\n", uidgidFile, data)
+	}
+
+	if err := writeCtl(fs, adm, []byte("nodropbox /box")); err != nil {
+		t.Fatalf("nodropbox /box: %v\n", err)
+	}
+	if fs.onlyOwn(box, users.Uname2User("nuts"), users) {
+		t.Error("box is still a drop box")
+	}
+}
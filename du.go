@@ -0,0 +1,94 @@
+package vufs
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Usage is the bytes in plain files, and the number of files
+// (directories included), that a user owns or a group has.
+type Usage struct {
+	Bytes int64 `json:"bytes"`
+	Files int64 `json:"files"`
+}
+
+// Usage by user and by group name.
+type UsageByOwner struct {
+	Users  map[string]*Usage `json:"users"`
+	Groups map[string]*Usage `json:"groups"`
+}
+
+func newUsageByOwner() *UsageByOwner {
+	return &UsageByOwner{make(map[string]*Usage), make(map[string]*Usage)}
+}
+
+func (o *UsageByOwner) add(user, group string, d usage) {
+	for _, c := range []struct {
+		m    map[string]*Usage
+		name string
+	}{{o.Users, user}, {o.Groups, group}} {
+		if c.m[c.name] == nil {
+			c.m[c.name] = &Usage{}
+		}
+		c.m[c.name].Bytes += d.bytes
+		c.m[c.name].Files += d.files
+	}
+}
+
+// A DiskUsage is what the files under a root use.
+type DiskUsage struct {
+	// The whole tree.
+	Total *UsageByOwner `json:"total"`
+	// If asked for, each directory and everything in it, including
+	// the directory, by path from the root ("/" for the root).
+	Dirs map[string]*UsageByOwner `json:"dirs,omitempty"`
+}
+
+// DiskUsage adds up the bytes and files owned by each user and group
+// under the root, as quotas count them, and, if byDir is set, in each
+// directory.  Ids that aren't users are reported by number.
+func (u *VuFs) DiskUsage(byDir bool) (*DiskUsage, error) {
+
+	du := &DiskUsage{Total: newUsageByOwner()}
+	if byDir {
+		du.Dirs = make(map[string]*UsageByOwner)
+	}
+
+	err := u.walkUsage(func(path string, st os.FileInfo, uid, gid int) error {
+		d := fileUsage(st)
+		user, group := strconv.Itoa(uid), strconv.Itoa(gid)
+		if x := u.Upool.Uid2User(uid); x != nil {
+			user = x.Name()
+		}
+		if x := u.Upool.Gid2Group(gid); x != nil {
+			group = x.Name()
+		}
+		du.Total.add(user, group, d)
+
+		if !byDir {
+			return nil
+		}
+		rel, err := filepath.Rel(u.Root, path)
+		if err != nil {
+			return err
+		}
+		// A directory counts in itself; a file starts with its parent.
+		dir := "/" + rel
+		if !st.IsDir() {
+			dir = filepath.Dir(dir)
+		}
+		for {
+			if du.Dirs[dir] == nil {
+				du.Dirs[dir] = newUsageByOwner()
+			}
+			du.Dirs[dir].add(user, group, d)
+			if dir == "/" {
+				return nil
+			}
+			dir = filepath.Dir(dir)
+		}
+	})
+
+	return du, err
+}
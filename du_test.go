@@ -0,0 +1,81 @@
+package vufs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDiskUsage(t *testing.T) {
+
+	root, users := scratchRoot(t)
+	defer os.RemoveAll(root)
+
+	// mark owns a and d/c, nuts owns d, and d/e has an id that isn't a user.
+	a, d := filepath.Join(root, "a"), filepath.Join(root, "d")
+	ioutil.WriteFile(a, []byte("abc"), 0644)
+	os.Mkdir(d, 0755)
+	ioutil.WriteFile(filepath.Join(d, "c"), []byte("01234"), 0644)
+	ioutil.WriteFile(filepath.Join(d, "e"), []byte("0"), 0644)
+	fs := &VuFs{Root: root}
+	fs.Upool = users
+	fs.meta().Set(a, nil, Meta{Uid: 2, Gid: 2, Muid: 2})
+	fs.meta().Set(d, nil, Meta{Uid: 3, Gid: 3, Muid: 3})
+	fs.meta().Set(filepath.Join(d, "c"), nil, Meta{Uid: 2, Gid: 3, Muid: 2})
+	fs.meta().Set(filepath.Join(d, "e"), nil, Meta{Uid: 9, Gid: 9, Muid: 9})
+
+	du, err := fs.DiskUsage(false)
+	if err != nil {
+		t.Fatalf("DiskUsage: %v\n", err)
+	}
+	if du.Dirs != nil {
+		t.Errorf("DiskUsage(false) has directories: %v\n", du.Dirs)
+	}
+
+	// adm has adm, adm/users and b.
+	admUsage := Usage{Bytes: du.Total.Users["adm"].Bytes, Files: 3}
+	want := &UsageByOwner{
+		Users: map[string]*Usage{
+			"adm":  &admUsage,
+			"mark": {Bytes: 8, Files: 2},
+			"nuts": {Bytes: 0, Files: 1},
+			"9":    {Bytes: 1, Files: 1},
+		},
+		Groups: map[string]*Usage{
+			"adm":  &admUsage,
+			"mark": {Bytes: 3, Files: 1},
+			"nuts": {Bytes: 5, Files: 2},
+			"9":    {Bytes: 1, Files: 1},
+		},
+	}
+	if !reflect.DeepEqual(du.Total, want) {
+		t.Errorf("total is %v, expected %v\n", du.Total, want)
+	}
+
+	du, err = fs.DiskUsage(true)
+	if err != nil {
+		t.Fatalf("DiskUsage: %v\n", err)
+	}
+	if !reflect.DeepEqual(du.Dirs["/"], du.Total) {
+		t.Errorf("/ is %v, not the total %v\n", du.Dirs["/"], du.Total)
+	}
+	wantd := &UsageByOwner{
+		Users: map[string]*Usage{
+			"mark": {Bytes: 5, Files: 1},
+			"nuts": {Bytes: 0, Files: 1},
+			"9":    {Bytes: 1, Files: 1},
+		},
+		Groups: map[string]*Usage{
+			"nuts": {Bytes: 5, Files: 2},
+			"9":    {Bytes: 1, Files: 1},
+		},
+	}
+	if !reflect.DeepEqual(du.Dirs["/d"], wantd) {
+		t.Errorf("/d is %v, expected %v\n", du.Dirs["/d"], wantd)
+	}
+	if len(du.Dirs) != 3 {
+		t.Errorf("expected /, /adm and /d, got %v\n", du.Dirs)
+	}
+}
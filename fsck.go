@@ -0,0 +1,263 @@
+package vufs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/lionkov/go9p/p"
+)
+
+// A problem found by Fsck.  File is a .uidgid file, and Line the line
+// in it, or (if Line is zero) File is the file the problem is with.
+type FsckProblem struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (p FsckProblem) String() string {
+	if p.Line == 0 {
+		return fmt.Sprintf("%s: %s", p.File, p.Msg)
+	}
+	return fmt.Sprintf("%s:%d: %s", p.File, p.Line, p.Msg)
+}
+
+// Fsck checks the .uidgid files under root for
+//
+//	lines that don't parse
+//	more than one line for a file
+//	lines for files that don't exist
+//	files with no line (created without going through vufs)
+//	ids (including directory defaults' groups and ACL entries) that
+//	aren't users in upool
+//	temporary files left by a crash
+//
+// and returns what it found.  If repair is set, it also fixes them:
+// bad lines, duplicates and lines for missing files are dropped,
+// files with no line or unknown ids get owner (uid) and group (gid),
+// defaults with an unknown group leave the group alone, ACL entries
+// for unknown ids are dropped,
+// and temporary files are removed.  The root itself is not checked;
+// its owner doesn't come from a .uidgid file under root.  Nor are
+// adm/, adm/users and adm/quotas, when they have no owner: they are
+// adm's, and a repair records that rather than giving them to owner.
+// The server must not be running during a repair.
+func Fsck(root string, upool p.Users, repair bool, owner Meta) ([]FsckProblem, error) {
+
+	problems := make([]FsckProblem, 0)
+	fs := &VuFs{Root: root}
+
+	err := filepath.Walk(root, func(path string, st os.FileInfo, err error) error {
+		// A temporary file removed by the repair.
+		if os.IsNotExist(err) && path != root {
+			return nil
+		}
+		if err != nil || !st.IsDir() {
+			return err
+		}
+		found, err := fsckDir(fs, path, upool, repair, owner)
+		problems = append(problems, found...)
+		return err
+	})
+
+	return problems, err
+}
+
+func fsckDir(fs *VuFs, dir string, upool p.Users, repair bool, owner Meta) ([]FsckProblem, error) {
+
+	problems := make([]FsckProblem, 0)
+	fn := filepath.Join(dir, uidgidFile)
+	add := func(line int, format string, a ...interface{}) {
+		problems = append(problems, FsckProblem{fn, line, fmt.Sprintf(format, a...)})
+	}
+	addFile := func(name, msg string) {
+		problems = append(problems, FsckProblem{filepath.Join(dir, name), 0, msg})
+	}
+
+	data, err := ioutil.ReadFile(fn)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	names, err := readDirNames(dir)
+	if err != nil {
+		return nil, err
+	}
+	exists := make(map[string]bool)
+	for _, name := range names {
+		exists[name] = true
+	}
+
+	entries := make(map[string]Meta)
+	lineOf := make(map[string]int)
+	for i, line := range strings.Split(string(data), "\n") {
+		n := i + 1
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		columns := strings.Split(line, ":")
+		m, err := parseMeta(columns[1:])
+		if err != nil || columns[0] == "" || columns[0] == uidgidFile {
+			add(n, "bad line '%s'", line)
+			continue
+		}
+		name := columns[0]
+		if prev, dup := lineOf[name]; dup {
+			add(prev, "'%s' is also on line %d", name, n)
+		}
+		if !exists[name] {
+			add(n, "'%s' does not exist", name)
+			continue
+		}
+		entries[name] = fsckIds(m, upool, owner, func(format string, a ...interface{}) {
+			add(n, "'%s' "+format, append([]interface{}{name}, a...)...)
+		})
+		lineOf[name] = n
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].Line < problems[j].Line })
+
+	changed := len(problems) > 0
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		switch {
+		case isTempOf(name, uidgidFile) && name != uidgidFile:
+			addFile(name, "temporary file left behind")
+			if repair {
+				if err := os.Remove(path); err != nil {
+					return problems, err
+				}
+			}
+		case fs.isMetaFile(path):
+		case lineOf[name] == 0 && fs.isAdmFile(path):
+			if adm, ok := admMeta(upool); ok {
+				entries[name] = adm
+				changed = true
+			}
+		case lineOf[name] == 0:
+			addFile(name, "has no owner")
+			entries[name] = owner
+			changed = true
+		}
+	}
+
+	if repair && changed {
+		if err := writeUidGid(dir, entries); err != nil {
+			return problems, err
+		}
+	}
+
+	return problems, nil
+}
+
+// Check the ids in m, reporting each that isn't in upool, and return
+// m repaired: an unknown owner or group becomes owner's, a default
+// group is dropped, and so are ACL entries.
+func fsckIds(m Meta, upool p.Users, owner Meta, report func(format string, a ...interface{})) Meta {
+	if upool.Uid2User(m.Uid) == nil {
+		report("has unknown owner id %d", m.Uid)
+		m.Uid, m.Muid = owner.Uid, owner.Uid
+	}
+	if upool.Gid2Group(m.Gid) == nil {
+		report("has unknown group id %d", m.Gid)
+		m.Gid = owner.Gid
+	}
+	if d := m.Defaults; d != nil && d.Gid != NoGid && upool.Gid2Group(d.Gid) == nil {
+		report("has unknown default group id %d", d.Gid)
+		m.Defaults = &DirDefaults{Gid: NoGid, Mask: d.Mask, Force: d.Force}
+	}
+	if len(m.ACL) > 0 {
+		acl := make([]ACLEntry, 0, len(m.ACL))
+		for _, e := range m.ACL {
+			if (e.Group && upool.Gid2Group(e.Id) == nil) || (!e.Group && upool.Uid2User(e.Id) == nil) {
+				report("has ACL entry %s for an unknown id", e)
+				continue
+			}
+			acl = append(acl, e)
+		}
+		m.ACL = acl
+	}
+	return m
+}
+
+// FsckStore does for a tree whose owners are kept in store (the kv or
+// xattr store) what Fsck does for .uidgid files: it reports files
+// with no owner and ids that aren't users in upool, and if repair is
+// set fixes them in the same way.  The server must not be running
+// during a repair.
+func FsckStore(root string, upool p.Users, store MetaStore, repair bool, owner Meta) ([]FsckProblem, error) {
+
+	problems := make([]FsckProblem, 0)
+	fs := &VuFs{Root: root, Meta: store}
+
+	err := filepath.Walk(root, func(path string, st os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root || fs.isMetaFile(path) {
+			return nil
+		}
+		add := func(format string, a ...interface{}) {
+			problems = append(problems, FsckProblem{path, 0, fmt.Sprintf(format, a...)})
+		}
+
+		m, found, err := store.Get(path, st)
+		if err != nil {
+			return err
+		}
+		fixed := owner
+		switch {
+		case found:
+			fixed = fsckIds(m, upool, owner, add)
+		case fs.isAdmFile(path):
+			adm, ok := admMeta(upool)
+			if !ok {
+				return nil
+			}
+			fixed = adm
+		default:
+			add("has no owner")
+		}
+		if repair && (!found || !reflect.DeepEqual(fixed, m)) {
+			return store.Set(path, st, fixed)
+		}
+		return nil
+	})
+
+	return problems, err
+}
+
+// True if path is adm/ or one of the files vufs reads from it.
+func (u *VuFs) isAdmFile(path string) bool {
+	for _, fn := range []string{filepath.Dir(usersFile), usersFile, quotasFile} {
+		if filepath.Clean(path) == filepath.Join(u.Root, fn) {
+			return true
+		}
+	}
+	return false
+}
+
+// A Meta giving a file to adm.
+func admMeta(upool p.Users) (Meta, bool) {
+	adm := upool.Uname2User(admUser)
+	if adm == nil {
+		return Meta{}, false
+	}
+	return Meta{Uid: adm.Id(), Gid: adm.Id(), Muid: adm.Id()}, true
+}
+
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	sort.Strings(names)
+	return names, err
+}
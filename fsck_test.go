@@ -0,0 +1,108 @@
+package vufs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFsck(t *testing.T) {
+
+	root, users := scratchRoot(t)
+	defer os.RemoveAll(root)
+
+	fn := filepath.Join(root, uidgidFile)
+	err := ioutil.WriteFile(fn, []byte("a:2:3\nbad\ngone:2:2\na:9:3\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(fn+"123", []byte("a:2:3\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		fn + ":1: 'a' is also on line 4",
+		fn + ":2: bad line 'bad'",
+		fn + ":3: 'gone' does not exist",
+		fn + ":4: 'a' has unknown owner id 9",
+		filepath.Join(root, uidgidFile+"123") + ": temporary file left behind",
+		filepath.Join(root, "b") + ": has no owner",
+	}
+
+	// adm/ and adm/users stay adm's, whoever gets the rest.
+	mark := Meta{Uid: 2, Gid: 2, Muid: 2}
+	for _, repair := range []bool{false, true} {
+		problems, err := Fsck(root, users, repair, mark)
+		if err != nil {
+			t.Fatalf("Fsck(%v): %v\n", repair, err)
+		}
+		if len(problems) != len(expected) {
+			t.Errorf("Fsck(%v): expected %d problems, got %v\n", repair, len(expected), problems)
+			continue
+		}
+		for i, p := range problems {
+			if p.String() != expected[i] {
+				t.Errorf("Fsck(%v): got '%s', expected '%s'\n", repair, p, expected[i])
+			}
+		}
+	}
+
+	// Repaired.
+	problems, err := Fsck(root, users, false, mark)
+	if err != nil || len(problems) != 0 {
+		t.Errorf("problems left after repair: %v, %v\n", problems, err)
+	}
+	data, _ := ioutil.ReadFile(fn)
+	if string(data) != "a:2:3\nadm:1:1\nb:2:2\n" {
+		t.Errorf("%s after repair:\n%s\n", uidgidFile, data)
+	}
+	data, _ = ioutil.ReadFile(filepath.Join(root, "adm", uidgidFile))
+	if string(data) != "users:1:1\n" {
+		t.Errorf("adm/%s after repair:\n%s\n", uidgidFile, data)
+	}
+}
+
+func TestFsckStore(t *testing.T) {
+
+	root, users := scratchRoot(t)
+	defer os.RemoveAll(root)
+
+	kv, err := NewKVStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := filepath.Join(root, "a")
+	kv.Set(a, nil, Meta{Uid: 9, Gid: 3, Muid: 9})
+
+	expected := []string{
+		a + ": has unknown owner id 9",
+		filepath.Join(root, "b") + ": has no owner",
+	}
+	owner := Meta{Uid: 2, Gid: 2, Muid: 2}
+	for _, repair := range []bool{false, true} {
+		problems, err := FsckStore(root, users, kv, repair, owner)
+		if err != nil {
+			t.Fatalf("FsckStore(repair %v): %v\n", repair, err)
+		}
+		if len(problems) != len(expected) {
+			t.Fatalf("FsckStore(repair %v) found %v, expected %v\n", repair, problems, expected)
+		}
+		for i, p := range problems {
+			if p.String() != expected[i] {
+				t.Errorf("problem %d is '%s', expected '%s'\n", i, p, expected[i])
+			}
+		}
+	}
+
+	if problems, _ := FsckStore(root, users, kv, false, owner); len(problems) != 0 {
+		t.Errorf("problems after repair: %v\n", problems)
+	}
+	if m, _, _ := kv.Get(a, nil); m.Uid != 2 || m.Gid != 3 {
+		t.Errorf("a is %v after repair, expected owner 2 and group 3\n", m)
+	}
+	if m, _, _ := kv.Get(filepath.Join(root, usersFile), nil); m.Uid != 1 || m.Gid != 1 {
+		t.Errorf("%s is %v after repair, expected adm's\n", usersFile, m)
+	}
+}
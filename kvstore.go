@@ -0,0 +1,390 @@
+package vufs
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// The key-value store, relative to the root.
+const metaFile = "adm/meta"
+
+/*
+The key-value store keeps the Meta of every file under the root in
+one file, adm/meta, indexed by the file's device and inode numbers, so
+a lookup never reads anything from disk and moving a directory needs
+no update for the files in it.  The whole store is held in memory.
+
+With each Meta goes the file's name (its last element), which a
+rename through vufs updates.  An entry whose name doesn't match is
+for a file removed on the host whose inode has been reused, and is
+ignored; so a file renamed on the host loses its owner.
+
+The file is a log, one change per line:
+
+	dev:ino name uid gid [muid mode ...]	set the Meta of a file
+	dev:ino -				forget a file
+
+with the name escaped as in a URL path.  A change is appended and
+synced before it takes effect, and a later line for a file replaces
+earlier ones.  The log is compacted (written
+whole to a temporary file that is renamed over it) when it is opened
+and when it has grown to several times the number of files it
+describes.  A line cut short by a crash is ignored.
+
+When the store is first created, the .uidgid files under the root are
+read into it.  They are left in place, but no longer used.  Lines from
+before devices and names were kept (qpath uid gid ...) are matched to
+files by inode when the log is opened.
+*/
+type kvStore struct {
+	sync.Mutex
+	file    string
+	log     *os.File
+	entries map[kvID]kvEntry
+	// Lines in the log.
+	lines int
+	// While opening, entries in the old format, by inode.
+	legacy map[uint64]Meta
+}
+
+// A file's device and inode numbers.
+type kvID struct {
+	dev, ino uint64
+}
+
+func (id kvID) String() string {
+	return fmt.Sprintf("%d:%d", id.dev, id.ino)
+}
+
+type kvEntry struct {
+	name string
+	m    Meta
+}
+
+// Compact once the log has this many lines for each file in it.
+const kvCompactRatio = 4
+
+// NewKVStore opens the key-value store under root, creating it from
+// the .uidgid files under root if it doesn't exist yet.
+func NewKVStore(root string) (*kvStore, error) {
+
+	kv := &kvStore{file: filepath.Join(root, metaFile), entries: make(map[kvID]kvEntry)}
+
+	if err := kv.read(root); err != nil {
+		return nil, err
+	}
+
+	if err := kv.compact(); err != nil {
+		return nil, err
+	}
+
+	return kv, nil
+}
+
+// NewReadOnlyKVStore opens the key-value store under root for reading,
+// as the commands that run beside a live server do.  The log is
+// neither compacted nor, if there is none yet, created (the .uidgid
+// files are read instead, as the server would read them), and Set and
+// Delete fail.
+func NewReadOnlyKVStore(root string) (*kvStore, error) {
+
+	kv := &kvStore{file: filepath.Join(root, metaFile), entries: make(map[kvID]kvEntry)}
+
+	if err := kv.read(root); err != nil {
+		return nil, err
+	}
+
+	return kv, nil
+}
+
+// Read the log, or if there is none the .uidgid files, into memory.
+func (kv *kvStore) read(root string) error {
+	data, err := ioutil.ReadFile(kv.file)
+	switch {
+	case os.IsNotExist(err):
+		return kv.migrate(root)
+	case err != nil:
+		return err
+	}
+	kv.parse(data)
+	if len(kv.legacy) > 0 {
+		err = kv.upgrade(root)
+	}
+	kv.legacy = nil
+	return err
+}
+
+func (kv *kvStore) parse(data []byte) {
+	kv.legacy = make(map[uint64]Meta)
+	for n, line := range strings.Split(string(data), "\n") {
+		columns := strings.Fields(line)
+		if len(columns) == 0 {
+			continue
+		}
+		if err := kv.parseLine(columns); err != nil {
+			log.Printf("%s:%d: ignoring bad line '%s'\n", kv.file, n+1, line)
+		}
+	}
+}
+
+func (kv *kvStore) parseLine(columns []string) error {
+
+	// An old line: qpath uid gid ...
+	if !strings.Contains(columns[0], ":") {
+		ino, err := strconv.ParseUint(columns[0], 10, 64)
+		if err != nil {
+			return err
+		}
+		if len(columns) == 2 && columns[1] == "-" {
+			delete(kv.legacy, ino)
+			return nil
+		}
+		m, err := parseMeta(columns[1:])
+		if err == nil {
+			kv.legacy[ino] = m
+		}
+		return err
+	}
+
+	var id kvID
+	if _, err := fmt.Sscanf(columns[0], "%d:%d", &id.dev, &id.ino); err != nil {
+		return err
+	}
+	if len(columns) == 2 && columns[1] == "-" {
+		delete(kv.entries, id)
+		return nil
+	}
+	if len(columns) < 3 {
+		return fmt.Errorf("short line")
+	}
+	name, err := url.PathUnescape(columns[1])
+	if err != nil {
+		return err
+	}
+	m, err := parseMeta(columns[2:])
+	if err == nil {
+		kv.entries[id] = kvEntry{name, m}
+	}
+	return err
+}
+
+// Match the old lines, which only have an inode number, to the files
+// under root.  Those for files that are gone are dropped.
+func (kv *kvStore) upgrade(root string) error {
+	return filepath.Walk(root, func(path string, st os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		id := statID(st)
+		if m, found := kv.legacy[id.ino]; found {
+			if _, taken := kv.entries[id]; !taken {
+				kv.entries[id] = kvEntry{filepath.Base(path), m}
+			}
+			delete(kv.legacy, id.ino)
+		}
+		return nil
+	})
+}
+
+// Read every .uidgid file under root into the store.
+func (kv *kvStore) migrate(root string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return err
+		}
+		entries, err := readUidGid(path)
+		if err != nil {
+			return err
+		}
+		for name, m := range entries {
+			st, err := os.Lstat(filepath.Join(path, name))
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			kv.entries[statID(st)] = kvEntry{name, m}
+		}
+		return nil
+	})
+}
+
+// Rewrite the log with one line per file, and reopen it for appends.
+// The caller holds kv's lock (or is NewKVStore).
+func (kv *kvStore) compact() error {
+
+	ids := make([]kvID, 0, len(kv.entries))
+	for id := range kv.entries {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i].dev < ids[j].dev || (ids[i].dev == ids[j].dev && ids[i].ino < ids[j].ino)
+	})
+
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	for _, id := range ids {
+		fmt.Fprint(w, kvLine(id, kv.entries[id]))
+	}
+	w.Flush()
+
+	err := os.MkdirAll(filepath.Dir(kv.file), 0700)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(kv.file), filepath.Base(kv.file))
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(buf.Bytes())
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = tmp.Chmod(0600)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), kv.file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if kv.log != nil {
+		kv.log.Close()
+	}
+	kv.log, err = os.OpenFile(kv.file, os.O_WRONLY|os.O_APPEND, 0600)
+	kv.lines = len(ids)
+	return err
+}
+
+// Append a line to the log, compacting it if it has grown too long.
+// The caller holds kv's lock.
+func (kv *kvStore) append(line string) error {
+	if kv.log == nil {
+		return fmt.Errorf("%s: opened read only", kv.file)
+	}
+	if _, err := kv.log.WriteString(line); err != nil {
+		return err
+	}
+	if err := kv.log.Sync(); err != nil {
+		return err
+	}
+	kv.lines++
+	if kv.lines > kvCompactRatio*(len(kv.entries)+1) {
+		return kv.compact()
+	}
+	return nil
+}
+
+func kvLine(id kvID, e kvEntry) string {
+	return fmt.Sprintf("%s %s %s\n", id, url.PathEscape(e.name), strings.Join(e.m.columns(), " "))
+}
+
+// The device and inode numbers of st.
+func statID(st os.FileInfo) kvID {
+	sys := st.Sys().(*syscall.Stat_t)
+	return kvID{uint64(sys.Dev), uint64(sys.Ino)}
+}
+
+// The id of the file at path, which is st (or, if st is nil, found
+// with Lstat).
+func kvKey(path string, st os.FileInfo) (kvID, error) {
+	if st == nil {
+		var err error
+		if st, err = os.Lstat(path); err != nil {
+			return kvID{}, err
+		}
+	}
+	return statID(st), nil
+}
+
+func (kv *kvStore) Get(path string, st os.FileInfo) (Meta, bool, error) {
+	id, err := kvKey(path, st)
+	if os.IsNotExist(err) {
+		return Meta{}, false, nil
+	}
+	if err != nil {
+		return Meta{}, false, err
+	}
+	kv.Lock()
+	defer kv.Unlock()
+	e, found := kv.entries[id]
+	if !found || e.name != filepath.Base(path) {
+		return Meta{}, false, nil
+	}
+	return e.m, true, nil
+}
+
+func (kv *kvStore) Set(path string, st os.FileInfo, m Meta) error {
+	id, err := kvKey(path, st)
+	if err != nil {
+		return err
+	}
+	e := kvEntry{filepath.Base(path), m}
+	kv.Lock()
+	defer kv.Unlock()
+	if err = kv.append(kvLine(id, e)); err != nil {
+		return err
+	}
+	kv.entries[id] = e
+	return nil
+}
+
+// The id doesn't change, but the name that goes with it does.
+func (kv *kvStore) Rename(oldpath, newpath string, st os.FileInfo) error {
+	id, err := kvKey(newpath, st)
+	if err != nil {
+		return err
+	}
+	kv.Lock()
+	defer kv.Unlock()
+	e, found := kv.entries[id]
+	if !found || e.name != filepath.Base(oldpath) || e.name == filepath.Base(newpath) {
+		return nil
+	}
+	e.name = filepath.Base(newpath)
+	if err = kv.append(kvLine(id, e)); err != nil {
+		return err
+	}
+	kv.entries[id] = e
+	return nil
+}
+
+func (kv *kvStore) Delete(path string, st os.FileInfo) error {
+	if st == nil {
+		return nil
+	}
+	// The file lives on under its other names.
+	if sys, ok := st.Sys().(*syscall.Stat_t); ok && !st.IsDir() && sys.Nlink > 1 {
+		return nil
+	}
+	id := statID(st)
+	kv.Lock()
+	defer kv.Unlock()
+	if _, found := kv.entries[id]; !found {
+		return nil
+	}
+	if err := kv.append(fmt.Sprintf("%s -\n", id)); err != nil {
+		return err
+	}
+	delete(kv.entries, id)
+	return nil
+}
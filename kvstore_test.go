@@ -0,0 +1,264 @@
+package vufs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// A scratch root with adm/users and the files a and b.
+func scratchRoot(t *testing.T) (string, *vUsers) {
+
+	root, err := ioutil.TempDir("", "vufs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.MkdirAll(filepath.Join(root, "adm"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(root, usersFile), []byte("1:adm:\n2:mark:\n3:nuts:\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fn := range []string{"a", "b"} {
+		if err = ioutil.WriteFile(filepath.Join(root, fn), []byte{}, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	users, err := NewVusers(root)
+	if err != nil {
+		t.Fatalf("NewVusers(%s): %v\n", root, err)
+	}
+
+	return root, users
+}
+
+func TestKVStore(t *testing.T) {
+
+	root, users := scratchRoot(t)
+	defer os.RemoveAll(root)
+
+	kv, err := NewKVStore(root)
+	if err != nil {
+		t.Fatalf("NewKVStore(%s): %v\n", root, err)
+	}
+	fs := &VuFs{Root: root, Meta: kv}
+
+	a, b := filepath.Join(root, "a"), filepath.Join(root, "b")
+	if err = kv.Set(a, nil, Meta{Uid: 2, Gid: 3, Muid: 2}); err != nil {
+		t.Fatalf("Set(a): %v\n", err)
+	}
+	if err = kv.Set(b, nil, Meta{Uid: 3, Gid: 3, Muid: 3}); err != nil {
+		t.Fatalf("Set(b): %v\n", err)
+	}
+	if err = kv.Set(b, nil, Meta{Uid: 2, Gid: 2, Muid: 2}); err != nil {
+		t.Fatalf("Set(b): %v\n", err)
+	}
+
+	// Ownership follows a file renamed through vufs.
+	c := filepath.Join(root, "c")
+	if err = os.Rename(a, c); err != nil {
+		t.Fatal(err)
+	}
+	st, _ := os.Lstat(c)
+	if err = kv.Rename(a, c, st); err != nil {
+		t.Fatalf("Rename(a, c): %v\n", err)
+	}
+	user, group, err := fs.path2UserGroup(c, nil, users)
+	if err != nil || user != "mark" || group != "nuts" {
+		t.Errorf("owner of c: %s, %s, %v; expected mark, nuts\n", user, group, err)
+	}
+
+	// But not one renamed on the host, which may as well be a new
+	// file that reused the inode.
+	d := filepath.Join(root, "d")
+	if err = os.Rename(c, d); err != nil {
+		t.Fatal(err)
+	}
+	if m, found, err := kv.Get(d, nil); found || err != nil {
+		t.Errorf("d has c's owner: %v, %v\n", m, err)
+	}
+	os.Rename(d, c)
+
+	os.Remove(c)
+	if err = kv.Delete(c, st); err != nil {
+		t.Fatalf("Delete(c): %v\n", err)
+	}
+
+	// A crash while appending leaves a partial line.
+	kv.log.WriteString("12")
+	kv.log.Close()
+
+	kv, err = NewKVStore(root)
+	if err != nil {
+		t.Fatalf("reopen NewKVStore(%s): %v\n", root, err)
+	}
+	if len(kv.entries) != 1 {
+		t.Errorf("expected just b in the store, got %v\n", kv.entries)
+	}
+	if m, found, _ := kv.Get(b, nil); !found || !reflect.DeepEqual(m, Meta{Uid: 2, Gid: 2, Muid: 2}) {
+		t.Errorf("b after reopen: %v, %v; expected {2 2 2 0}\n", m, found)
+	}
+
+	// The log was compacted.
+	data, _ := ioutil.ReadFile(filepath.Join(root, metaFile))
+	if n := len(data); n == 0 || data[n-1] != '\n' || kv.lines != 1 {
+		t.Errorf("%s not compacted:\n%s\n", metaFile, data)
+	}
+}
+
+func TestKVUpgrade(t *testing.T) {
+
+	root, _ := scratchRoot(t)
+	defer os.RemoveAll(root)
+
+	// A log from when entries were keyed by inode alone.
+	a, b := filepath.Join(root, "a"), filepath.Join(root, "b")
+	sta, _ := os.Lstat(a)
+	stb, _ := os.Lstat(b)
+	ino := func(st os.FileInfo) uint64 { return statID(st).ino }
+	old := fmt.Sprintf("%d 2 3\n%d 3 3\n%d -\n999999999 2 2\n", ino(sta), ino(stb), ino(stb))
+	err := ioutil.WriteFile(filepath.Join(root, metaFile), []byte(old), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kv, err := NewKVStore(root)
+	if err != nil {
+		t.Fatalf("NewKVStore(%s): %v\n", root, err)
+	}
+	if m, found, _ := kv.Get(a, nil); !found || m.Uid != 2 || m.Gid != 3 {
+		t.Errorf("a after upgrade: %v, %v; expected {2 3 ...}\n", m, found)
+	}
+	if len(kv.entries) != 1 {
+		t.Errorf("expected just a in the store, got %v\n", kv.entries)
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(root, metaFile))
+	if want := statID(sta).String() + " a "; !strings.HasPrefix(string(data), want) {
+		t.Errorf("%s not rewritten; expected '%s...', got:\n%s\n", metaFile, want, data)
+	}
+}
+
+func TestKVMigrate(t *testing.T) {
+
+	root, users := scratchRoot(t)
+	defer os.RemoveAll(root)
+
+	err := os.Mkdir(filepath.Join(root, "d"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(root, "d", "e"), []byte{}, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(root, uidgidFile), []byte("a:2:3\nd:3:3\ngone:2:2\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(root, "d", uidgidFile), []byte("e:2:2\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kv, err := NewKVStore(root)
+	if err != nil {
+		t.Fatalf("NewKVStore(%s): %v\n", root, err)
+	}
+	fs := &VuFs{Root: root, Meta: kv}
+
+	tests := []struct {
+		path  string
+		user  string
+		group string
+	}{
+		{"a", "mark", "nuts"},
+		{"b", "adm", "adm"},
+		{"d", "nuts", "nuts"},
+		{"d/e", "mark", "mark"},
+	}
+	for _, tt := range tests {
+		user, group, err := fs.path2UserGroup(filepath.Join(root, tt.path), nil, users)
+		if err != nil || user != tt.user || group != tt.group {
+			t.Errorf("owner of %s: %s, %s, %v; expected %s, %s\n",
+				tt.path, user, group, err, tt.user, tt.group)
+		}
+	}
+	if len(kv.entries) != 3 {
+		t.Errorf("expected 3 entries, got %v\n", kv.entries)
+	}
+
+	// Migration only happens once.
+	os.Remove(filepath.Join(root, "d", uidgidFile))
+	kv, err = NewKVStore(root)
+	if err != nil {
+		t.Fatalf("reopen NewKVStore(%s): %v\n", root, err)
+	}
+	if len(kv.entries) != 3 {
+		t.Errorf("expected 3 entries after reopen, got %v\n", kv.entries)
+	}
+
+	if !fs.isMetaFile(filepath.Join(root, metaFile)) {
+		t.Errorf("%s isn't hidden\n", metaFile)
+	}
+}
+
+func TestReadOnlyKVStore(t *testing.T) {
+
+	root, _ := scratchRoot(t)
+	defer os.RemoveAll(root)
+
+	// With no log yet, the .uidgid files are read, and no log is made.
+	a := filepath.Join(root, "a")
+	if err := NewUidGidStore().Set(a, nil, Meta{Uid: 2, Gid: 3, Muid: 2}); err != nil {
+		t.Fatal(err)
+	}
+	kv, err := NewReadOnlyKVStore(root)
+	if err != nil {
+		t.Fatalf("NewReadOnlyKVStore(%s): %v\n", root, err)
+	}
+	if m, found, _ := kv.Get(a, nil); !found || m.Uid != 2 {
+		t.Errorf("a: %v, %v; expected uid 2\n", m, found)
+	}
+	if _, err = os.Stat(filepath.Join(root, metaFile)); !os.IsNotExist(err) {
+		t.Errorf("%s was created: %v\n", metaFile, err)
+	}
+
+	// An existing log is neither compacted nor changed.
+	rw, err := NewKVStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw.Set(a, nil, Meta{Uid: 3, Gid: 3, Muid: 3})
+	before, _ := ioutil.ReadFile(filepath.Join(root, metaFile))
+	kv, err = NewReadOnlyKVStore(root)
+	if err != nil {
+		t.Fatalf("NewReadOnlyKVStore(%s): %v\n", root, err)
+	}
+	if m, _, _ := kv.Get(a, nil); m.Uid != 3 {
+		t.Errorf("a has uid %d, expected 3\n", m.Uid)
+	}
+	if err = kv.Set(a, nil, Meta{Uid: 1, Gid: 1, Muid: 1}); err == nil {
+		t.Error("Set in a read only store")
+	}
+	after, _ := ioutil.ReadFile(filepath.Join(root, metaFile))
+	if string(before) != string(after) {
+		t.Errorf("%s changed from\n%s\nto\n%s\n", metaFile, before, after)
+	}
+
+	// Nor are users created.
+	os.Remove(filepath.Join(root, usersFile))
+	if _, err = OpenVusers(root); err == nil {
+		t.Error("OpenVusers with no adm/users")
+	}
+	if _, err = os.Stat(filepath.Join(root, usersFile)); !os.IsNotExist(err) {
+		t.Errorf("%s was created: %v\n", usersFile, err)
+	}
+}
@@ -0,0 +1,265 @@
+package vufs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/srv"
+)
+
+// The sticky bit of a directory (see mayUnlink), as 9P2000.u clients
+// such as Linux's v9fs send it.
+const DMSTICKY = 0x00010000
+
+// The Plan 9 mode bits vufs keeps in Meta.Mode rather than on the host
+// file: append only, exclusive use, temporary, and, for 9P2000.u
+// clients, set-user-id, set-group-id and sticky.
+const metaModeBits = p.DMAPPEND | p.DMEXCL | p.DMTMP | p.DMSETUID | p.DMSETGID | DMSTICKY
+
+// The .u bits, which a 9P2000 client can neither see nor clear.
+const dotuModeBits = p.DMSETUID | p.DMSETGID | DMSTICKY
+
+// Meta is what vufs knows about a file beyond what the host file
+// system records: its virtual owner and group, who last changed it,
+// and any Plan 9 mode bits other than the permissions and DMDIR.
+type Meta struct {
+	Uid  int
+	Gid  int
+	Muid int
+	Mode uint32
+	// For a directory, what the files created in it get, or nil.
+	// A DirDefaults is never changed once it is in a Meta.
+	Defaults *DirDefaults
+	// Who else may (or may not) use the file; nil if its mode says
+	// it all.  Like Defaults, never changed in place.
+	ACL []ACLEntry
+	// For a directory, whether it is a drop box (see onlyOwn).
+	Dropbox bool
+}
+
+// The fields of m as text, for the stores that keep it that way: uid
+// and gid, then muid and mode, unless they are the defaults (muid the
+// same as uid, no mode bits), then any optional fields as key=value.
+func (m Meta) columns() []string {
+	columns := []string{strconv.Itoa(m.Uid), strconv.Itoa(m.Gid)}
+	if m.Muid != m.Uid || m.Mode != 0 || m.Defaults != nil || len(m.ACL) > 0 || m.Dropbox {
+		columns = append(columns, strconv.Itoa(m.Muid), fmt.Sprintf("%#x", m.Mode))
+	}
+	if m.Defaults != nil {
+		columns = append(columns, "defaults="+m.Defaults.String())
+	}
+	if len(m.ACL) > 0 {
+		columns = append(columns, "acl="+formatACL(m.ACL))
+	}
+	if m.Dropbox {
+		columns = append(columns, "dropbox=true")
+	}
+	return columns
+}
+
+// The Meta in columns, as written by Meta.columns.
+func parseMeta(columns []string) (Meta, error) {
+	var m Meta
+	var err error
+	if len(columns) != 2 && len(columns) < 4 {
+		return m, fmt.Errorf("expected 2 or at least 4 fields, got %d", len(columns))
+	}
+	if m.Uid, err = strconv.Atoi(columns[0]); err != nil {
+		return m, err
+	}
+	if m.Gid, err = strconv.Atoi(columns[1]); err != nil {
+		return m, err
+	}
+	m.Muid = m.Uid
+	if len(columns) >= 4 {
+		if m.Muid, err = strconv.Atoi(columns[2]); err != nil {
+			return m, err
+		}
+		mode, err := strconv.ParseUint(columns[3], 0, 32)
+		if err != nil {
+			return m, err
+		}
+		m.Mode = uint32(mode)
+	}
+	var options []string
+	if len(columns) > 4 {
+		options = columns[4:]
+	}
+	for _, column := range options {
+		kv := strings.SplitN(column, "=", 2)
+		if len(kv) != 2 {
+			return m, fmt.Errorf("bad field '%s'", column)
+		}
+		switch kv[0] {
+		case "defaults":
+			if m.Defaults, err = parseDirDefaults(kv[1]); err != nil {
+				return m, err
+			}
+		case "acl":
+			if m.ACL, err = parseACL(kv[1]); err != nil {
+				return m, err
+			}
+		case "dropbox":
+			if m.Dropbox, err = strconv.ParseBool(kv[1]); err != nil {
+				return m, err
+			}
+		default:
+			return m, fmt.Errorf("unknown field '%s'", kv[0])
+		}
+	}
+	return m, nil
+}
+
+// A MetaStore keeps the Meta of the files under a VuFs root.  Each
+// method gets the host path of the file and, if the caller has it,
+// the result of stat-ing it (st may be nil).  Set and Delete are
+// called with the lock on the file's directory held (see dirLocks).
+type MetaStore interface {
+	// Get returns the Meta recorded for path, and false if there
+	// is none.
+	Get(path string, st os.FileInfo) (Meta, bool, error)
+
+	// Set records the Meta for path, which exists.
+	Set(path string, st os.FileInfo, m Meta) error
+
+	// Delete forgets path, which has just been removed; st is from
+	// before the remove.
+	Delete(path string, st os.FileInfo) error
+
+	// Rename moves the Meta of oldpath, which has just been renamed
+	// to newpath, and is st.  The caller holds the locks on both
+	// directories.
+	Rename(oldpath, newpath string, st os.FileInfo) error
+}
+
+// The store to use; a VuFs with no Meta set keeps ownership in
+// .uidgid files.
+func (u *VuFs) meta() MetaStore {
+	if u.Meta == nil {
+		return &u.uidgids
+	}
+	return u.Meta
+}
+
+// The mode bits recorded for path (see metaModeBits), or 0 if there
+// are none.  The root has none; like its owner, its Meta would be
+// kept outside the tree.
+func (u *VuFs) metaMode(path string, st os.FileInfo) uint32 {
+	if u.isRoot(path) {
+		return 0
+	}
+	m, found, err := u.meta().Get(path, st)
+	if err != nil || !found {
+		return 0
+	}
+	return m.Mode & metaModeBits
+}
+
+// The qid of path, which is st, with the type bits that go with its
+// recorded mode (QTAPPEND for DMAPPEND, and so on).
+func (u *VuFs) path2Qid(path string, st os.FileInfo) *p.Qid {
+	qid := dir2Qid(st)
+	qid.Type |= uint8(u.metaMode(path, st) >> 24)
+	return qid
+}
+
+// Record mode (only its metaModeBits) as the mode of path.  The
+// caller holds the lock on path's directory.
+func (u *VuFs) setMetaMode(path string, st os.FileInfo, mode uint32, upool p.Users) error {
+	mode &= metaModeBits
+	if u.metaMode(path, st) == mode {
+		return nil
+	}
+	return u.changeMeta(path, st, upool, func(m *Meta) {
+		m.Mode = m.Mode&^metaModeBits | mode
+	})
+}
+
+// Apply change to the Meta of path.  A file with no Meta yet gets one,
+// owned by whoever owns it now.  The root's Meta isn't kept under the
+// root, so it can't be changed.  The caller holds the lock on path's
+// directory.
+func (u *VuFs) changeMeta(path string, st os.FileInfo, upool p.Users, change func(m *Meta)) error {
+
+	if u.isRoot(path) {
+		return srv.Eperm
+	}
+	m, found, err := u.meta().Get(path, st)
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		uid, gid, err := u.path2UserGroup(path, st, upool)
+		if err != nil {
+			return err
+		}
+		user, group := upool.Uname2User(uid), upool.Gname2Group(gid)
+		if user == nil || group == nil {
+			return fmt.Errorf("no user '%s' or group '%s'", uid, gid)
+		}
+		m = Meta{Uid: user.Id(), Gid: group.Id(), Muid: user.Id()}
+	}
+
+	change(&m)
+	return u.meta().Set(path, st, m)
+}
+
+// True if path names one of vufs' metadata files: a .uidgid file, the
+// key-value store, or one of the temporary files they are rewritten
+// through.  Clients can't see these except in the admin view, and
+// nobody can change them.
+func (u *VuFs) isMetaFile(path string) bool {
+	path = filepath.Clean(path)
+	if isTempOf(filepath.Base(path), uidgidFile) {
+		return true
+	}
+	kv := filepath.Join(u.Root, metaFile)
+	return filepath.Dir(path) == filepath.Dir(kv) && isTempOf(filepath.Base(path), filepath.Base(kv))
+}
+
+// True if name is base, or a temporary file made from it by
+// ioutil.TempFile (base followed by digits).
+func isTempOf(name, base string) bool {
+	if !strings.HasPrefix(name, base) {
+		return false
+	}
+	for _, c := range name[len(base):] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// CopyMeta copies the Meta of every file under root (but not root
+// itself, or vufs' own files) from one store to another, and returns
+// how many files it copied.  Files with no Meta in from are left
+// alone.  Nothing is removed from from.  The server must not be
+// running.
+func CopyMeta(root string, from, to MetaStore) (int, error) {
+	u := &VuFs{Root: root}
+	n := 0
+	err := filepath.Walk(root, func(path string, st os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root || u.isMetaFile(path) {
+			return nil
+		}
+		m, found, err := from.Get(path, st)
+		if err != nil || !found {
+			return err
+		}
+		if err = to.Set(path, st, m); err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	return n, err
+}
@@ -0,0 +1,77 @@
+package vufs
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/lionkov/go9p/p"
+)
+
+func TestMetaMode(t *testing.T) {
+
+	root, users := scratchRoot(t)
+	defer os.RemoveAll(root)
+
+	fs := &VuFs{Root: root, Meta: NewUidGidStore()}
+	a, b := filepath.Join(root, "a"), filepath.Join(root, "b")
+	if err := fs.Meta.Set(a, nil, Meta{Uid: 2, Gid: 3, Muid: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	// b has no owner yet, so it gets the one it has now (adm).
+	if err := fs.setMetaMode(b, nil, p.DMAPPEND|p.DMDIR|0644, users); err != nil {
+		t.Fatalf("setMetaMode(b): %v\n", err)
+	}
+	if m, _, _ := fs.Meta.Get(b, nil); !reflect.DeepEqual(m, Meta{Uid: 1, Gid: 1, Muid: 1, Mode: p.DMAPPEND}) {
+		t.Errorf("Meta of b is %v, expected {1 1 1 DMAPPEND}\n", m)
+	}
+
+	if err := fs.setMetaMode(a, nil, p.DMEXCL|p.DMSETUID, users); err != nil {
+		t.Fatalf("setMetaMode(a): %v\n", err)
+	}
+	// Reread from disk.
+	fs.Meta = NewUidGidStore()
+	st, _ := os.Stat(a)
+	d, err := fs.dir2Dir(a, st, users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Uid != "mark" || d.Gid != "nuts" {
+		t.Errorf("owner of a is %s, %s; expected mark, nuts\n", d.Uid, d.Gid)
+	}
+	if want := p.DMEXCL | p.DMSETUID | uint32(st.Mode()&0777); d.Mode != want {
+		t.Errorf("mode of a is %#x, expected %#x\n", d.Mode, want)
+	}
+	if d.Qid.Type != p.QTEXCL || fs.path2Qid(a, st).Type != p.QTEXCL {
+		t.Errorf("qid type of a is %#x, expected QTEXCL\n", d.Qid.Type)
+	}
+
+	if err := fs.setMetaMode(root, nil, p.DMTMP, users); err == nil {
+		t.Error("set the mode bits of the root")
+	}
+}
+
+func TestIsMetaFile(t *testing.T) {
+	fs := &VuFs{Root: "/r"}
+	tests := []struct {
+		path string
+		meta bool
+	}{
+		{"/r/" + uidgidFile, true},
+		{"/r/d/" + uidgidFile, true},
+		{"/r/d/" + uidgidFile + "123", true},
+		{"/r/" + metaFile, true},
+		{"/r/" + metaFile + "42", true},
+		{"/r/d/" + uidgidFile + "-notes", false},
+		{"/r/" + metaFile + "data.txt", false},
+		{"/r/d/meta", false},
+		{"/r/a", false},
+	}
+	for _, tt := range tests {
+		if fs.isMetaFile(tt.path) != tt.meta {
+			t.Errorf("isMetaFile(%s) = %v\n", tt.path, !tt.meta)
+		}
+	}
+}
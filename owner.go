@@ -0,0 +1,111 @@
+package vufs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/lionkov/go9p/p"
+)
+
+// An OwnerPolicy decides who owns a file that has no owner recorded
+// in the MetaStore, for example one created on the host rather than
+// through vufs.
+type OwnerPolicy int
+
+const (
+	// Untracked files belong to DefaultOwner and DefaultGroup.
+	OwnDefault OwnerPolicy = iota
+	// Untracked files belong to the owner and group of their
+	// directory.
+	OwnInherit
+	// Nobody may use untracked files; they are left out of
+	// directory listings.
+	OwnDeny
+)
+
+var Euntracked = &p.Error{Err: "file has no owner", Errornum: p.EPERM}
+
+// ParseOwnerPolicy returns the policy called s: default, inherit or
+// deny.
+func ParseOwnerPolicy(s string) (OwnerPolicy, error) {
+	switch s {
+	case "default":
+		return OwnDefault, nil
+	case "inherit":
+		return OwnInherit, nil
+	case "deny":
+		return OwnDeny, nil
+	}
+	return 0, fmt.Errorf("unknown owner policy '%s'", s)
+}
+
+// The name, or adm if name is empty.
+func orAdm(name string) string {
+	if name == "" {
+		return admUser
+	}
+	return name
+}
+
+// True if path is the root of the tree.
+func (u *VuFs) isRoot(path string) bool {
+	return filepath.Clean(path) == filepath.Clean(u.Root)
+}
+
+// Look up the name for a user id.  An id that isn't a user (say, one
+// deleted from adm/users) is shown as the number, so that the file can
+// still be listed, and its directory used, until fsck repairs it.
+func uid2name(uid int, upool p.Users) string {
+
+	u := upool.Uid2User(uid)
+
+	if u == nil {
+		return strconv.Itoa(uid)
+	}
+
+	return u.Name()
+
+}
+
+// Lookup (uid, gid) for a file (path = full path to file, e.g. './tmpfs/test.txt').
+// st is the file's stat, or nil.
+func (u *VuFs) path2UserGroup(path string, st os.FileInfo, upool p.Users) (string, string, error) {
+	user, group, _, err := u.path2Users(path, st, upool)
+	return user, group, err
+}
+
+// Lookup the owner, group and last modifier of a file.  The root is
+// owned by RootOwner and RootGroup, and files with no recorded owner
+// (other than adm/) by whoever the Untracked policy says.
+func (u *VuFs) path2Users(path string, st os.FileInfo, upool p.Users) (string, string, string, error) {
+
+	if u.isRoot(path) {
+		return orAdm(u.RootOwner), orAdm(u.RootGroup), orAdm(u.RootOwner), nil
+	}
+
+	e, found, err := u.meta().Get(path, st)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	if !found {
+		// adm/, which vufs makes on the host, holds the synthetic
+		// files, so it is adm's whatever the policy.
+		if path == filepath.Join(u.Root, filepath.Dir(usersFile)) {
+			return admUser, admUser, admUser, nil
+		}
+		switch u.Untracked {
+		case OwnInherit:
+			if parent := filepath.Dir(path); parent != path {
+				return u.path2Users(parent, nil, upool)
+			}
+		case OwnDeny:
+			return "", "", "", Euntracked
+		}
+		return orAdm(u.DefaultOwner), orAdm(u.DefaultGroup), orAdm(u.DefaultOwner), nil
+	}
+
+	return uid2name(e.Uid, upool), uid2name(e.Gid, upool), uid2name(e.Muid, upool), nil
+}
@@ -0,0 +1,59 @@
+package vufs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOwnerPolicy(t *testing.T) {
+
+	root, users := scratchRoot(t)
+	defer os.RemoveAll(root)
+
+	// d is marked's, d/e and b have no owner.
+	os.Mkdir(filepath.Join(root, "d"), 0755)
+	os.Create(filepath.Join(root, "d", "e"))
+	s := NewUidGidStore()
+	s.Set(filepath.Join(root, "a"), nil, Meta{Uid: 2, Gid: 3, Muid: 2})
+	s.Set(filepath.Join(root, "d"), nil, Meta{Uid: 2, Gid: 2, Muid: 2})
+
+	tests := []struct {
+		policy OwnerPolicy
+		path   string
+		user   string
+		group  string
+	}{
+		{OwnDefault, "", "nuts", "mark"},
+		{OwnDefault, "a", "mark", "nuts"},
+		{OwnDefault, "b", "adm", "nuts"},
+		{OwnDefault, "d/e", "adm", "nuts"},
+		{OwnInherit, "a", "mark", "nuts"},
+		{OwnInherit, "b", "nuts", "mark"},
+		{OwnInherit, "d/e", "mark", "mark"},
+		{OwnDeny, "a", "mark", "nuts"},
+		{OwnDeny, "b", "", ""},
+		{OwnDeny, "", "nuts", "mark"},
+	}
+
+	for _, tt := range tests {
+		fs := &VuFs{Root: root, Meta: s, Untracked: tt.policy,
+			DefaultGroup: "nuts", RootOwner: "nuts", RootGroup: "mark"}
+		user, group, err := fs.path2UserGroup(filepath.Join(root, tt.path), nil, users)
+		if tt.user == "" {
+			if err != Euntracked {
+				t.Errorf("policy %d, '%s': got %s, %s, %v; expected Euntracked\n",
+					tt.policy, tt.path, user, group, err)
+			}
+			continue
+		}
+		if err != nil || user != tt.user || group != tt.group {
+			t.Errorf("policy %d, '%s': got %s, %s, %v; expected %s, %s\n",
+				tt.policy, tt.path, user, group, err, tt.user, tt.group)
+		}
+	}
+
+	if _, err := ParseOwnerPolicy("sometimes"); err == nil {
+		t.Error("ParseOwnerPolicy accepted 'sometimes'")
+	}
+}
@@ -0,0 +1,453 @@
+package vufs
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/lionkov/go9p/p"
+)
+
+// The quota file, relative to the root.
+const quotasFile = "adm/quotas"
+
+var Equota = &p.Error{Err: "disk quota exceeded", Errornum: uint32(syscall.EDQUOT)}
+
+/*
+The quota file limits the bytes and the number of files (directories
+included) that a user may own, or that may be in a group, one limit
+per line:
+
+	user name bytes files
+	group name bytes files
+
+bytes may end in K, M, G or T (powers of 1024), and either limit may
+be - for none.  Lines starting with # are comments.  An edit takes
+effect with the next change to the tree.
+
+Once usage is over a limit, nothing that would add to it is allowed:
+a Create, a Write past the end of a file, a Wstat that makes a file
+longer or moves it into the group.  What a change would add is
+reserved, under the lock, before the change is made, so that changes
+made at once can't together go over.  Usage is counted when quotas are
+enabled and kept up to date from then on; files changed on the host
+are not noticed until the next start.
+*/
+type quotas struct {
+	sync.Mutex
+	on     bool
+	users  map[int]*usage
+	groups map[int]*usage
+	// The limits in the quota file, and its size and modification
+	// time when it was read.
+	userLimits  map[int]usage
+	groupLimits map[int]usage
+	size        int64
+	mtime       time.Time
+}
+
+// Bytes and files used, or allowed.
+type usage struct {
+	bytes int64
+	files int64
+}
+
+// For a limit, none.
+const unlimited = -1
+
+// For quotaCheckIds, no user.
+const noId = -1
+
+// The usage of a file: its length, if it is a plain file, and one.
+func fileUsage(st os.FileInfo) usage {
+	if st.Mode().IsRegular() {
+		return usage{st.Size(), 1}
+	}
+	return usage{0, 1}
+}
+
+// EnableQuotas counts the space used by each user and group and, from
+// then on, keeps the count up to date and enforces the limits in the
+// quota file.  It must be called before the server starts.
+func (u *VuFs) EnableQuotas() error {
+
+	q := &u.quotas
+	q.users = make(map[int]*usage)
+	q.groups = make(map[int]*usage)
+
+	err := u.walkUsage(func(path string, st os.FileInfo, uid, gid int) error {
+		q.add(uid, gid, fileUsage(st))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	q.on = true
+	q.Lock()
+	defer q.Unlock()
+	return u.loadQuotas()
+}
+
+// Call fn with the owners of each file under the root (but
+// not the root itself), skipping vufs' own files and, with -untracked
+// deny, files nobody owns.
+func (u *VuFs) walkUsage(fn func(path string, st os.FileInfo, uid, gid int) error) error {
+	return filepath.Walk(u.Root, func(path string, st os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if u.isRoot(path) || u.isMetaFile(path) {
+			return nil
+		}
+		uid, gid, err := u.fileIds(path, st)
+		if err == Euntracked {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return fn(path, st, uid, gid)
+	})
+}
+
+// The ids of the owner and group of path, which is st.
+func (u *VuFs) fileIds(path string, st os.FileInfo) (int, int, error) {
+
+	if !u.isRoot(path) {
+		m, found, err := u.meta().Get(path, st)
+		if err != nil {
+			return 0, 0, err
+		}
+		if found {
+			return m.Uid, m.Gid, nil
+		}
+	}
+
+	uname, gname, err := u.path2UserGroup(path, st, u.Upool)
+	if err != nil {
+		return 0, 0, err
+	}
+	user, group := u.Upool.Uname2User(uname), u.Upool.Gname2Group(gname)
+	if user == nil || group == nil {
+		return 0, 0, fmt.Errorf("no user '%s' or group '%s'", uname, gname)
+	}
+	return user.Id(), group.Id(), nil
+}
+
+// Read the quota file, if it has changed.  The caller holds q's lock.
+func (u *VuFs) loadQuotas() error {
+
+	q := &u.quotas
+	fn := filepath.Join(u.Root, quotasFile)
+	st, err := os.Stat(fn)
+	if os.IsNotExist(err) {
+		q.userLimits, q.groupLimits = nil, nil
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if q.userLimits != nil && st.Size() == q.size && st.ModTime().Equal(q.mtime) {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+	q.userLimits, q.groupLimits = make(map[int]usage), make(map[int]usage)
+	q.size, q.mtime = st.Size(), st.ModTime()
+
+	for n, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if err := u.parseQuota(fields); err != nil {
+			log.Printf("%s:%d: %v\n", fn, n+1, err)
+		}
+	}
+	return nil
+}
+
+func (u *VuFs) parseQuota(fields []string) error {
+
+	q := &u.quotas
+	if len(fields) != 4 {
+		return fmt.Errorf("expected 4 fields, got %d", len(fields))
+	}
+	var limit usage
+	var err error
+	if limit.bytes, err = parseLimit(fields[2], true); err != nil {
+		return err
+	}
+	if limit.files, err = parseLimit(fields[3], false); err != nil {
+		return err
+	}
+
+	switch fields[0] {
+	case "user":
+		user := u.Upool.Uname2User(fields[1])
+		if user == nil {
+			return fmt.Errorf("no user '%s'", fields[1])
+		}
+		q.userLimits[user.Id()] = limit
+	case "group":
+		group := u.Upool.Gname2Group(fields[1])
+		if group == nil {
+			return fmt.Errorf("no group '%s'", fields[1])
+		}
+		q.groupLimits[group.Id()] = limit
+	default:
+		return fmt.Errorf("expected user or group, got '%s'", fields[0])
+	}
+	return nil
+}
+
+// A limit: a number, or - for unlimited.  Sizes can end in K, M, G or T.
+func parseLimit(s string, size bool) (int64, error) {
+	if s == "-" {
+		return unlimited, nil
+	}
+	var scale int64 = 1
+	digits := s
+	if size && len(s) > 0 {
+		if i := strings.IndexByte("KMGT", s[len(s)-1]); i >= 0 {
+			scale = 1 << (10 * uint(i+1))
+			digits = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad limit '%s'", s)
+	}
+	return n * scale, nil
+}
+
+// True if used plus d is over limit.  Only what d adds counts, so
+// that a user over quota can still free space.
+func over(used *usage, d usage, limit usage, found bool) bool {
+	if !found {
+		return false
+	}
+	if used == nil {
+		used = &usage{}
+	}
+	return (d.bytes > 0 && limit.bytes != unlimited && used.bytes+d.bytes > limit.bytes) ||
+		(d.files > 0 && limit.files != unlimited && used.files+d.files > limit.files)
+}
+
+// Equota if adding d to the usage of uid and gid would take either
+// over its limit.  The caller holds q's lock.
+func (u *VuFs) overQuota(uid, gid int, d usage) error {
+	q := &u.quotas
+	if err := u.loadQuotas(); err != nil {
+		log.Printf("%s: %v\n", quotasFile, err)
+	}
+	ul, ufound := q.userLimits[uid]
+	gl, gfound := q.groupLimits[gid]
+	if over(q.users[uid], d, ul, ufound) || over(q.groups[gid], d, gl, gfound) {
+		return Equota
+	}
+	return nil
+}
+
+// Add d to the usage of uid and gid.  The caller holds q's lock (or
+// is EnableQuotas).
+func (q *quotas) add(uid, gid int, d usage) {
+	for _, c := range []struct {
+		m  map[int]*usage
+		id int
+	}{{q.users, uid}, {q.groups, gid}} {
+		if c.m[c.id] == nil {
+			c.m[c.id] = &usage{}
+		}
+		c.m[c.id].bytes += d.bytes
+		c.m[c.id].files += d.files
+	}
+}
+
+// Equota if path (which is st) may not grow by d.
+func (u *VuFs) quotaCheck(path string, st os.FileInfo, d usage) error {
+	if !u.quotas.on {
+		return nil
+	}
+	uid, gid, err := u.fileIds(path, st)
+	if err != nil {
+		return err
+	}
+	return u.quotaCheckIds(uid, gid, d)
+}
+
+// Equota if uid and gid may not use d more.
+func (u *VuFs) quotaCheckIds(uid, gid int, d usage) error {
+	if !u.quotas.on {
+		return nil
+	}
+	u.quotas.Lock()
+	defer u.quotas.Unlock()
+	return u.overQuota(uid, gid, d)
+}
+
+// Reserve d for path (which is st), or return Equota if it would take
+// its owner or group over a limit.  The caller gives back what it
+// doesn't use with quotaAdd.
+func (u *VuFs) quotaReserve(path string, st os.FileInfo, d usage) error {
+	if !u.quotas.on {
+		return nil
+	}
+	uid, gid, err := u.fileIds(path, st)
+	if err != nil {
+		return err
+	}
+	return u.quotaReserveIds(uid, gid, d)
+}
+
+func (u *VuFs) quotaReserveIds(uid, gid int, d usage) error {
+	if !u.quotas.on {
+		return nil
+	}
+	u.quotas.Lock()
+	defer u.quotas.Unlock()
+	if err := u.overQuota(uid, gid, d); err != nil {
+		return err
+	}
+	u.quotas.add(uid, gid, d)
+	return nil
+}
+
+// Count d more (or, if negative, less) against the owner and group of
+// path, which is st.
+func (u *VuFs) quotaAdd(path string, st os.FileInfo, d usage) {
+	if !u.quotas.on {
+		return
+	}
+	uid, gid, err := u.fileIds(path, st)
+	if err != nil {
+		log.Printf("quota for %s: %v\n", path, err)
+		return
+	}
+	u.quotaAddIds(uid, gid, d)
+}
+
+func (u *VuFs) quotaAddIds(uid, gid int, d usage) {
+	if !u.quotas.on {
+		return
+	}
+	u.quotas.Lock()
+	defer u.quotas.Unlock()
+	u.quotas.add(uid, gid, d)
+}
+
+// Move d from the usage of group oldgid to that of newgid, or return
+// Equota if it would take newgid over its limit.
+func (u *VuFs) quotaChgrp(oldgid, newgid int, d usage) error {
+	q := &u.quotas
+	if !q.on || oldgid == newgid {
+		return nil
+	}
+	q.Lock()
+	defer q.Unlock()
+	if err := u.overQuota(noId, newgid, d); err != nil {
+		return err
+	}
+	for _, c := range []struct {
+		id   int
+		sign int64
+	}{{oldgid, -1}, {newgid, 1}} {
+		if q.groups[c.id] == nil {
+			q.groups[c.id] = &usage{}
+		}
+		q.groups[c.id].bytes += c.sign * d.bytes
+		q.groups[c.id].files += c.sign * d.files
+	}
+	return nil
+}
+
+// The contents of adm/usage: a line for each user and group that uses
+// anything or has a limit,
+//
+//	user|group name bytes files byte-limit file-limit
+//
+// with - for no limit.
+func readUsage(u *VuFs) []byte {
+
+	q := &u.quotas
+	if !q.on {
+		return []byte{}
+	}
+	q.Lock()
+	defer q.Unlock()
+	if err := u.loadQuotas(); err != nil {
+		log.Printf("%s: %v\n", quotasFile, err)
+	}
+
+	lines := make([]string, 0)
+	for _, kind := range []struct {
+		name   string
+		used   map[int]*usage
+		limits map[int]usage
+		lookup func(id int) string
+	}{
+		{"user", q.users, q.userLimits, func(id int) string {
+			if user := u.Upool.Uid2User(id); user != nil {
+				return user.Name()
+			}
+			return strconv.Itoa(id)
+		}},
+		{"group", q.groups, q.groupLimits, func(id int) string {
+			if group := u.Upool.Gid2Group(id); group != nil {
+				return group.Name()
+			}
+			return strconv.Itoa(id)
+		}},
+	} {
+		ids := make(map[int]bool)
+		for id, used := range kind.used {
+			if *used != (usage{}) {
+				ids[id] = true
+			}
+		}
+		for id := range kind.limits {
+			ids[id] = true
+		}
+		named := make([]string, 0, len(ids))
+		for id := range ids {
+			used := usage{}
+			if kind.used[id] != nil {
+				used = *kind.used[id]
+			}
+			limit, found := kind.limits[id]
+			if !found {
+				limit = usage{unlimited, unlimited}
+			}
+			named = append(named, fmt.Sprintf("%s %s %d %d %s %s", kind.name, kind.lookup(id),
+				used.bytes, used.files, formatLimit(limit.bytes), formatLimit(limit.files)))
+		}
+		sort.Strings(named)
+		lines = append(lines, named...)
+	}
+
+	var buf bytes.Buffer
+	for _, line := range lines {
+		buf.WriteString(line + "\n")
+	}
+	return buf.Bytes()
+}
+
+func formatLimit(n int64) string {
+	if n == unlimited {
+		return "-"
+	}
+	return strconv.FormatInt(n, 10)
+}
@@ -0,0 +1,154 @@
+package vufs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestQuotas(t *testing.T) {
+
+	root, users := scratchRoot(t)
+	defer os.RemoveAll(root)
+
+	// mark owns a, which is ten bytes long, and is in group nuts.
+	a := filepath.Join(root, "a")
+	ioutil.WriteFile(a, []byte("0123456789"), 0644)
+	fs := &VuFs{Root: root}
+	fs.Upool = users
+	fs.meta().Set(a, nil, Meta{Uid: 2, Gid: 3, Muid: 2})
+
+	limits := "# limits\nuser mark 15 -\ngroup nuts - 1\ngroup nobody 1 1\nuser nuts 1X 1\n"
+	ioutil.WriteFile(filepath.Join(root, quotasFile), []byte(limits), 0644)
+
+	if err := fs.quotaCheck(a, nil, usage{100, 100}); err != nil {
+		t.Errorf("quotas are enforced before they are enabled: %v\n", err)
+	}
+	if err := fs.EnableQuotas(); err != nil {
+		t.Fatalf("EnableQuotas: %v\n", err)
+	}
+
+	report := string(readUsage(fs))
+	for _, line := range []string{"user mark 10 1 15 -\n", "group nuts 10 1 - 1\n"} {
+		if !strings.Contains(report, line) {
+			t.Errorf("adm/usage has no '%s' in '%s'\n", strings.TrimSpace(line), report)
+		}
+	}
+	if strings.Contains(report, "user nuts") {
+		t.Errorf("adm/usage has a bad limit in it: '%s'\n", report)
+	}
+
+	tests := []struct {
+		d  usage
+		ok bool
+	}{
+		{usage{5, 0}, true},
+		{usage{6, 0}, false},
+		{usage{0, 1}, false},
+		{usage{-10, -1}, true},
+	}
+	for _, tt := range tests {
+		err := fs.quotaCheck(a, nil, tt.d)
+		if (err == nil) != tt.ok {
+			t.Errorf("quotaCheck(a, %v): %v\n", tt.d, err)
+		}
+		if err != nil && err != Equota {
+			t.Errorf("quotaCheck(a, %v) = %v, not Equota\n", tt.d, err)
+		}
+	}
+
+	fs.quotaAdd(a, nil, usage{5, 0})
+	if err := fs.quotaCheck(a, nil, usage{1, 0}); err != Equota {
+		t.Errorf("mark can use 16 bytes: %v\n", err)
+	}
+
+	// Into adm's group and back.
+	fs.quotaChgrp(3, 1, usage{15, 1})
+	if !strings.Contains(string(readUsage(fs)), "group nuts 0 0 - 1\n") {
+		t.Errorf("chgrp left nuts's usage: '%s'\n", readUsage(fs))
+	}
+	if err := fs.quotaCheckIds(noId, 3, usage{15, 1}); err != nil {
+		t.Errorf("nuts has no room after chgrp: %v\n", err)
+	}
+	fs.quotaChgrp(1, 3, usage{15, 1})
+	if err := fs.quotaCheckIds(noId, 3, usage{0, 1}); err != Equota {
+		t.Errorf("nuts has room for two files: %v\n", err)
+	}
+
+	// Edits are picked up.
+	os.Remove(filepath.Join(root, quotasFile))
+	if err := fs.quotaCheck(a, nil, usage{1 << 30, 1}); err != nil {
+		t.Errorf("limits outlive the quota file: %v\n", err)
+	}
+}
+
+func TestQuotaReserve(t *testing.T) {
+
+	root, users := scratchRoot(t)
+	defer os.RemoveAll(root)
+
+	// mark owns a, and may own five bytes.
+	a := filepath.Join(root, "a")
+	fs := &VuFs{Root: root}
+	fs.Upool = users
+	fs.meta().Set(a, nil, Meta{Uid: 2, Gid: 3, Muid: 2})
+	ioutil.WriteFile(filepath.Join(root, quotasFile), []byte("user mark 5 -\n"), 0644)
+	if err := fs.EnableQuotas(); err != nil {
+		t.Fatalf("EnableQuotas: %v\n", err)
+	}
+
+	// Of twenty writers at once, each after a byte, five get one.
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	granted := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if fs.quotaReserve(a, nil, usage{1, 0}) == nil {
+				mu.Lock()
+				granted++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if granted != 5 {
+		t.Errorf("%d one-byte reservations granted, expected 5\n", granted)
+	}
+
+	// What's given back can be reserved again.
+	fs.quotaAdd(a, nil, usage{-2, 0})
+	if err := fs.quotaReserve(a, nil, usage{2, 0}); err != nil {
+		t.Errorf("returned bytes can't be reserved: %v\n", err)
+	}
+	if err := fs.quotaReserve(a, nil, usage{1, 0}); err != Equota {
+		t.Errorf("mark can reserve six bytes: %v\n", err)
+	}
+}
+
+func TestParseLimit(t *testing.T) {
+	tests := []struct {
+		s    string
+		size bool
+		n    int64
+		ok   bool
+	}{
+		{"-", true, unlimited, true},
+		{"100", true, 100, true},
+		{"2K", true, 2048, true},
+		{"1G", true, 1 << 30, true},
+		{"1G", false, 0, false},
+		{"-1", true, 0, false},
+		{"M", true, 0, false},
+	}
+	for _, tt := range tests {
+		n, err := parseLimit(tt.s, tt.size)
+		if (err == nil) != tt.ok || (tt.ok && n != tt.n) {
+			t.Errorf("parseLimit(%s, %v) = %d, %v\n", tt.s, tt.size, n, err)
+		}
+	}
+}
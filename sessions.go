@@ -0,0 +1,248 @@
+package vufs
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/srv"
+)
+
+var Edisabled = &p.Error{Err: "user disabled", Errornum: p.EPERM}
+
+// The connections to a VuFs: who attached on each, from where, since
+// when and with how many files open.  Only connections accepted
+// through VuFs.StartListener or VuFs.StartNetListener are tracked.
+// They are listed in adm/sessions and can be ended through adm/ctl.
+// Connections are kept by the server's Conn, not by address: clients
+// on a unix socket all have the same one.
+type sessions struct {
+	sync.Mutex
+	byConn map[*srv.Conn]*session
+	lastId int
+}
+
+type session struct {
+	id    int
+	conn  net.Conn
+	start time.Time
+	users map[p.User]bool
+	// Fids with a file open.
+	open int
+}
+
+// A listener that marks each connection it accepts, so that
+// ConnOpened knows to track it.
+type trackingListener struct {
+	net.Listener
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &trackedConn{c}, nil
+}
+
+// A connection whose remote address leads back to it.
+type trackedConn struct {
+	net.Conn
+}
+
+func (c *trackedConn) RemoteAddr() net.Addr {
+	return &trackedAddr{c.Conn.RemoteAddr(), c.Conn}
+}
+
+type trackedAddr struct {
+	net.Addr
+	conn net.Conn
+}
+
+// Start tracking conn, which the server made from c.
+func (ss *sessions) add(conn *srv.Conn, c net.Conn) {
+	ss.Lock()
+	defer ss.Unlock()
+	if ss.byConn == nil {
+		ss.byConn = make(map[*srv.Conn]*session)
+	}
+	ss.lastId++
+	ss.byConn[conn] = &session{
+		id:    ss.lastId,
+		conn:  c,
+		start: time.Now(),
+		users: make(map[p.User]bool)}
+}
+
+// Call f with the session for conn, if it is tracked.
+func (ss *sessions) with(conn *srv.Conn, f func(s *session)) {
+	ss.Lock()
+	defer ss.Unlock()
+	if s, ok := ss.byConn[conn]; ok {
+		f(s)
+	}
+}
+
+// StartListener serves connections from l, keeping track of them.
+func (u *VuFs) StartListener(l net.Listener) error {
+	return u.Srv.StartListener(&trackingListener{l})
+}
+
+// StartNetListener listens on addr and serves connections, keeping
+// track of them.
+func (u *VuFs) StartNetListener(ntype, addr string) error {
+	l, err := net.Listen(ntype, addr)
+	if err != nil {
+		return err
+	}
+	return u.StartListener(l)
+}
+
+// Track conn if it came from a trackingListener.
+func (u *VuFs) connected(conn *srv.Conn) {
+	if a, ok := conn.RemoteAddr().(*trackedAddr); ok {
+		u.sessions.add(conn, a.conn)
+	}
+}
+
+// Note that user attached on conn.
+func (u *VuFs) attached(conn *srv.Conn, user p.User) {
+	u.sessions.with(conn, func(s *session) { s.users[user] = true })
+}
+
+// Count files opened and closed on conn.
+func (u *VuFs) opened(conn *srv.Conn) {
+	u.sessions.with(conn, func(s *session) { s.open++ })
+}
+
+func (u *VuFs) unopened(conn *srv.Conn) {
+	u.sessions.with(conn, func(s *session) { s.open-- })
+}
+
+// Forget a connection once the server is done with it.
+func (u *VuFs) closed(conn *srv.Conn) {
+	u.sessions.Lock()
+	defer u.sessions.Unlock()
+	delete(u.sessions.byConn, conn)
+}
+
+// End the sessions for which match returns true, and return how many.
+func (u *VuFs) endSessions(match func(s *session) bool) int {
+	u.sessions.Lock()
+	defer u.sessions.Unlock()
+	n := 0
+	for _, s := range u.sessions.byConn {
+		if match(s) {
+			if u.Debuglevel > 0 {
+				log.Printf("%s: ending session %d\n", s.conn.RemoteAddr(), s.id)
+			}
+			s.conn.Close()
+			n++
+		}
+	}
+	return n
+}
+
+// True if user has been locked out.
+func isDisabled(user p.User) bool {
+	d, ok := user.(interface {
+		Disabled() bool
+	})
+	return ok && d.Disabled()
+}
+
+// EndDisabledSessions closes every connection on which a user that
+// is now disabled has attached.
+func (u *VuFs) EndDisabledSessions() {
+	u.endSessions(func(s *session) bool {
+		for user := range s.users {
+			if isDisabled(user) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// DisableUser locks a user out, records it in the user database and
+// ends the user's sessions.  Files the user owns keep showing its name.
+func (u *VuFs) DisableUser(name string) error {
+	d, ok := u.Upool.(interface {
+		SetDisabled(string, bool) error
+	})
+	if !ok {
+		return fmt.Errorf("users can't be disabled")
+	}
+	if err := d.SetDisabled(name, true); err != nil {
+		return err
+	}
+	u.EndDisabledSessions()
+	return nil
+}
+
+// The contents of adm/sessions: one line per connection, oldest
+// first, giving its id, remote address, start time, the number of
+// files it has open, and the users attached (or "-").
+func readSessions(u *VuFs) []byte {
+	u.sessions.Lock()
+	list := make([]*session, 0, len(u.sessions.byConn))
+	for _, s := range u.sessions.byConn {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].id < list[j].id })
+
+	var buf bytes.Buffer
+	for _, s := range list {
+		names := make([]string, 0, len(s.users))
+		for user := range s.users {
+			names = append(names, user.Name())
+		}
+		sort.Strings(names)
+		if len(names) == 0 {
+			names = append(names, "-")
+		}
+		fmt.Fprintf(&buf, "%d %s %s %d %s\n", s.id, s.conn.RemoteAddr(),
+			s.start.UTC().Format(time.RFC3339), s.open, strings.Join(names, ","))
+	}
+	u.sessions.Unlock()
+
+	return buf.Bytes()
+}
+
+// kill id
+func ctlKill(u *VuFs, args []string) error {
+	if len(args) != 1 {
+		return Ebadctl
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return Ebadctl
+	}
+	if u.endSessions(func(s *session) bool { return s.id == id }) == 0 {
+		return fmt.Errorf("no session %d", id)
+	}
+	return nil
+}
+
+// killuser name
+func ctlKillUser(u *VuFs, args []string) error {
+	if len(args) != 1 {
+		return Ebadctl
+	}
+	u.endSessions(func(s *session) bool {
+		for user := range s.users {
+			if user.Name() == args[0] {
+				return true
+			}
+		}
+		return false
+	})
+	return nil
+}
@@ -0,0 +1,65 @@
+/*
+   Copyright (c) 2015, Mark Bucciarelli <mkbucc@gmail.com>
+*/
+
+package vufs
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/lionkov/go9p/p/srv"
+)
+
+func TestSessionRegistry(t *testing.T) {
+
+	users, err := NewVusers("./test")
+	if err != nil {
+		t.Fatalf("NewVusers(./test): %v\n", err)
+	}
+
+	fs := New(rootdir)
+	fs.Upool = users
+
+	c, other := net.Pipe()
+	defer other.Close()
+	conn := &srv.Conn{}
+	fs.sessions.add(conn, c)
+	fs.sessions.with(conn, func(s *session) {
+		s.users[users.Uname2User("glenda")] = true
+		s.users[users.Uname2User("mark")] = true
+		s.open = 2
+	})
+
+	// A second connection from the same address, as on a unix socket.
+	c2, other2 := net.Pipe()
+	defer other2.Close()
+	fs.sessions.add(&srv.Conn{}, c2)
+
+	lines := strings.Split(strings.TrimSpace(string(readSessions(fs))), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected two sessions, got %q\n", lines)
+	}
+	fields := strings.Fields(lines[0])
+	if len(fields) != 5 || fields[0] != "1" || fields[3] != "2" || fields[4] != "glenda,mark" {
+		t.Errorf("wrong session line '%s'\n", lines[0])
+	}
+
+	for _, bad := range []string{"bogus", "kill", "kill x", "kill 3"} {
+		if err := writeCtl(fs, users.Uname2User("adm"), []byte(bad)); err == nil {
+			t.Errorf("ctl accepted '%s'\n", bad)
+		}
+	}
+
+	if err := writeCtl(fs, users.Uname2User("adm"), []byte("killuser mark\n")); err != nil {
+		t.Fatalf("killuser mark: %v\n", err)
+	}
+	if _, err := other.Write([]byte("x")); err == nil {
+		t.Error("mark's connection still open")
+	}
+	go c2.Read(make([]byte, 1))
+	if _, err := other2.Write([]byte("x")); err != nil {
+		t.Errorf("the other connection was closed too: %v\n", err)
+	}
+}
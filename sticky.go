@@ -0,0 +1,61 @@
+package vufs
+
+import (
+	"path/filepath"
+
+	"github.com/lionkov/go9p/p"
+)
+
+// True if user, who may write the directory path is in, may also take
+// path out of it, by removing or renaming it.  If the directory is
+// sticky (has DMSTICKY set), only the owner of the file, the owner of
+// the directory, or an administrator may; otherwise anyone may.  The
+// caller checks the permission on the directory.  The root is never
+// sticky.
+func (u *VuFs) mayUnlink(path string, user p.User, upool p.Users) bool {
+
+	dir := filepath.Dir(path)
+	if u.metaMode(dir, nil)&DMSTICKY == 0 || isAdmin(user, upool) {
+		return true
+	}
+
+	for _, f := range []string{path, dir} {
+		owner, _, err := u.path2UserGroup(f, nil, upool)
+		if err == nil && owner == user.Name() {
+			return true
+		}
+	}
+	return false
+}
+
+// Set or clear DMSTICKY on the directory name.
+func (u *VuFs) setSticky(name string, sticky bool) error {
+	path, st, err := u.ctlDir(name)
+	if err != nil {
+		return err
+	}
+	unlock := u.dirs.lock(filepath.Dir(path))
+	defer unlock()
+	return u.changeMeta(path, st, u.Upool, func(m *Meta) {
+		m.Mode &^= DMSTICKY
+		if sticky {
+			m.Mode |= DMSTICKY
+		}
+	})
+}
+
+// sticky dir
+func ctlSticky(u *VuFs, args []string) error {
+	if len(args) != 1 {
+		return Ebadctl
+	}
+	return u.setSticky(args[0], true)
+}
+
+// nosticky dir
+func ctlNoSticky(u *VuFs, args []string) error {
+	if len(args) != 1 {
+		return Ebadctl
+	}
+	return u.setSticky(args[0], false)
+}
@@ -0,0 +1,72 @@
+package vufs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSticky(t *testing.T) {
+
+	root, _ := scratchRoot(t)
+	defer os.RemoveAll(root)
+
+	err := ioutil.WriteFile(filepath.Join(root, usersFile), []byte("1:adm:\n2:mark:\n3:nuts:\n4:pat:\n5:ops:adm\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := NewVusers(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// mark owns scratch, nuts owns scratch/f.
+	scratch := filepath.Join(root, "scratch")
+	f := filepath.Join(scratch, "f")
+	os.Mkdir(scratch, 0777)
+	ioutil.WriteFile(f, []byte{}, 0666)
+	fs := &VuFs{Root: root}
+	fs.Upool = users
+	fs.meta().Set(scratch, nil, Meta{Uid: 2, Gid: 2, Muid: 2})
+	fs.meta().Set(f, nil, Meta{Uid: 3, Gid: 3, Muid: 3})
+
+	adm := users.Uname2User("adm")
+	for _, bad := range []string{"sticky", "sticky /a", "sticky /", "nosticky"} {
+		if err := writeCtl(fs, adm, []byte(bad)); err == nil {
+			t.Errorf("ctl accepted '%s'\n", bad)
+		}
+	}
+
+	tests := []struct {
+		sticky  bool
+		user    string
+		allowed bool
+	}{
+		{false, "pat", true},
+		{true, "pat", false},
+		{true, "nuts", true},
+		{true, "mark", true},
+		{true, "adm", true},
+		{true, "ops", true},
+	}
+
+	for _, tt := range tests {
+		cmd := "nosticky /scratch"
+		if tt.sticky {
+			cmd = "sticky /scratch"
+		}
+		if err := writeCtl(fs, adm, []byte(cmd)); err != nil {
+			t.Fatalf("%s: %v\n", cmd, err)
+		}
+		if fs.mayUnlink(f, users.Uname2User(tt.user), users) != tt.allowed {
+			t.Errorf("%s: %s may unlink f is not %v\n", cmd, tt.user, tt.allowed)
+		}
+	}
+
+	st, _ := os.Stat(scratch)
+	d, _ := fs.dir2Dir(scratch, st, users)
+	if d.Mode&DMSTICKY == 0 || d.Uid != "mark" {
+		t.Errorf("scratch has mode %#o, owner %s; expected DMSTICKY, mark\n", d.Mode, d.Uid)
+	}
+}
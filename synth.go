@@ -0,0 +1,190 @@
+package vufs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/srv"
+)
+
+// The administrator, who owns files with no recorded owner and
+// is the only one (with members of its group) to use synthetic files.
+const admUser = "adm"
+
+// A synthetic file is made up by vufs rather than stored on disk.
+// They all live in adm/ under the root, and only adm (or members of
+// group adm) may open them.  Reads see the contents as of the open.
+// Each write is a command.
+type synthFile struct {
+	name  string
+	mode  uint32
+	read  func(u *VuFs) []byte
+	write func(u *VuFs, user p.User, data []byte) error
+}
+
+var synthFiles = []*synthFile{
+	{"sessions", 0440, readSessions, nil},
+	{"ctl", 0220, nil, writeCtl},
+	{"acl", 0440, readACLs, nil},
+	{"usage", 0440, readUsage, nil},
+}
+
+var Ebadctl = &p.Error{Err: "bad control message", Errornum: p.EINVAL}
+
+// The synthetic file at path, or nil.
+func (u *VuFs) synthAt(path string) *synthFile {
+	if filepath.Dir(path) != filepath.Join(u.Root, filepath.Dir(usersFile)) {
+		return nil
+	}
+	name := filepath.Base(path)
+	for _, sf := range synthFiles {
+		if sf.name == name {
+			return sf
+		}
+	}
+	return nil
+}
+
+// True if user is adm or in group adm.  none never is, whatever
+// groups it is in.
+func isAdmin(user p.User, upool p.Users) bool {
+	if user == nil || isDisabled(user) || user.Name() == noneUser {
+		return false
+	}
+	if user.Name() == admUser {
+		return true
+	}
+	g := upool.Gname2Group(admUser)
+	return g != nil && user.IsMember(g)
+}
+
+// Synthetic files get qid paths with the top bit set, so they can't
+// collide with the inode numbers used for files on disk.
+func (sf *synthFile) qid() *p.Qid {
+	for i, f := range synthFiles {
+		if f == sf {
+			return &p.Qid{Type: p.QTFILE, Path: 1<<63 | uint64(i)}
+		}
+	}
+	return nil
+}
+
+// As in Plan 9, a synthetic file has length 0: its contents are only
+// made when it is opened.
+func (sf *synthFile) dir() *p.Dir {
+	dir := new(p.Dir)
+	dir.Qid = *sf.qid()
+	dir.Mode = sf.mode
+	dir.Name = sf.name
+	dir.Uid, dir.Gid, dir.Muid = admUser, admUser, admUser
+	return dir
+}
+
+func (u *VuFs) synthOpen(req *srv.Req, sf *synthFile) {
+	fid := req.Fid.Aux.(*Fid)
+	perm := mode2Perm(req.Tc.Mode)
+
+	if !isAdmin(req.Fid.User, req.Conn.Srv.Upool) ||
+		(perm&p.DMREAD != 0 && sf.read == nil) ||
+		(perm&p.DMWRITE != 0 && sf.write == nil) {
+		req.RespondError(srv.Eperm)
+		return
+	}
+
+	if sf.read != nil && perm&p.DMREAD != 0 {
+		fid.data = sf.read(u)
+	}
+
+	req.RespondRopen(sf.qid(), 0)
+}
+
+func (u *VuFs) synthRead(req *srv.Req, sf *synthFile) {
+	fid := req.Fid.Aux.(*Fid)
+	offset := req.Tc.Offset
+	if offset > uint64(len(fid.data)) {
+		offset = uint64(len(fid.data))
+	}
+	data := fid.data[offset:]
+	if len(data) > int(req.Tc.Count) {
+		data = data[:req.Tc.Count]
+	}
+	req.RespondRread(data)
+}
+
+func (u *VuFs) synthWrite(req *srv.Req, sf *synthFile) {
+	if sf.write == nil {
+		req.RespondError(srv.Eperm)
+		return
+	}
+	err := sf.write(u, req.Fid.User, req.Tc.Data)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+	req.RespondRwrite(uint32(len(req.Tc.Data)))
+}
+
+// The directory entries of the synthetic files, for reads of adm/.
+func (u *VuFs) synthDirs(path string) []*p.Dir {
+	dirs := make([]*p.Dir, 0)
+	if path != filepath.Join(u.Root, filepath.Dir(usersFile)) {
+		return dirs
+	}
+	for _, sf := range synthFiles {
+		if _, err := os.Lstat(filepath.Join(path, sf.name)); os.IsNotExist(err) {
+			dirs = append(dirs, sf.dir())
+		}
+	}
+	return dirs
+}
+
+// Run the commands written to adm/ctl, one per line:
+//
+//	kill id		end the session with this id (see adm/sessions)
+//	killuser name	end every session on which name attached
+//	defaults dir [group=name] [mask=perm] [force=perm]
+//			give files created in dir (a path from the
+//			root) this group, clear the permissions
+//			not in mask and set those in force (both
+//			octal); see DirDefaults
+//	nodefaults dir	remove the defaults of dir
+//	acl file [entry ...]
+//			set the ACL of file (a path from the root)
+//			to the entries, u:name or g:name followed
+//			by + (allow) or - (deny) and some of rwx;
+//			with no entries, remove it; see ACLEntry
+//	sticky dir	only let the owners of dir and of a file in
+//			it (and adm) remove or rename the file
+//	nosticky dir	let anyone who can write dir do that
+//	dropbox dir	let users see only their own files in dir
+//	nodropbox dir	let them see every file in dir
+func writeCtl(u *VuFs, user p.User, data []byte) error {
+	for _, line := range strings.Split(string(data), "\n") {
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+		cmd, ok := ctlCommands[args[0]]
+		if !ok {
+			return Ebadctl
+		}
+		if err := cmd(u, args[1:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var ctlCommands = map[string]func(u *VuFs, args []string) error{
+	"kill":       ctlKill,
+	"killuser":   ctlKillUser,
+	"defaults":   ctlDefaults,
+	"nodefaults": ctlNoDefaults,
+	"acl":        ctlSetACL,
+	"sticky":     ctlSticky,
+	"nosticky":   ctlNoSticky,
+	"dropbox":    ctlDropbox,
+	"nodropbox":  ctlNoDropbox,
+}
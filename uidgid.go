@@ -0,0 +1,296 @@
+package vufs
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lionkov/go9p/p"
+)
+
+/*
+Each directory has a .uidgid file that records, for the files in it,
+the ids of their virtual owner and group, one file per line:
+
+	name:uid:gid
+
+or, if the file was last changed by someone other than its owner or
+has Plan 9 mode bits that the host can't keep (see Meta):
+
+	name:uid:gid:muid:mode
+
+followed, for a file with any, by optional fields as key=value:
+
+	proj:2:3:2:0x0:defaults=3,0770,060
+
+If a name appears more than once, the last line wins; lines that
+don't parse are ignored.  The file is always replaced whole (written
+to a temporary file that is renamed over it), so a crash leaves
+either the old or the new version, and each rewrite drops duplicates
+and lines for files that are gone.
+*/
+
+// The store that keeps Meta in a .uidgid file in each directory.  It
+// caches the parsed contents of the files it reads, for the whole
+// server.  A cached directory is dropped when vufs rewrites its
+// .uidgid, and is re-read when the .uidgid file's inode, size or
+// modification time is not what it was when it was read (someone
+// edited it behind vufs' back).
+type uidgidStore struct {
+	sync.Mutex
+	dirs map[string]*uidgidDir
+}
+
+// The parsed .uidgid of one directory.
+type uidgidDir struct {
+	// The .uidgid file as it was when read; ino is zero if there
+	// was no .uidgid.
+	ino     uint64
+	size    int64
+	mtime   time.Time
+	entries map[string]Meta
+}
+
+// Stop caching (and start over) beyond this many directories.
+const uidgidCacheMax = 10000
+
+// NewUidGidStore returns the store that keeps Meta in a .uidgid file
+// in each directory.
+func NewUidGidStore() MetaStore {
+	return new(uidgidStore)
+}
+
+// The entries of the .uidgid file in dir, from the cache if they are
+// still current.
+func (s *uidgidStore) entries(dir string) (map[string]Meta, error) {
+
+	d := new(uidgidDir)
+	st, err := os.Stat(filepath.Join(dir, uidgidFile))
+	switch {
+	case err == nil:
+		d.ino, d.size, d.mtime = dir2Qid(st).Path, st.Size(), st.ModTime()
+	case !os.IsNotExist(err):
+		return nil, err
+	}
+
+	s.Lock()
+	cached, found := s.dirs[dir]
+	s.Unlock()
+	if found && cached.ino == d.ino && cached.size == d.size && cached.mtime.Equal(d.mtime) {
+		return cached.entries, nil
+	}
+
+	// If the file changes while we read it, the new contents are
+	// cached with the old validators and read again next time.
+	if d.entries, err = readUidGid(dir); err != nil {
+		return nil, err
+	}
+
+	s.Lock()
+	if s.dirs == nil || len(s.dirs) >= uidgidCacheMax {
+		s.dirs = make(map[string]*uidgidDir)
+	}
+	s.dirs[dir] = d
+	s.Unlock()
+
+	return d.entries, nil
+}
+
+// Forget the cached entries of dir.
+func (s *uidgidStore) invalidate(dir string) {
+	s.Lock()
+	delete(s.dirs, dir)
+	s.Unlock()
+}
+
+func (s *uidgidStore) Get(path string, st os.FileInfo) (Meta, bool, error) {
+	entries, err := s.entries(filepath.Dir(path))
+	if err != nil {
+		return Meta{}, false, err
+	}
+	m, found := entries[filepath.Base(path)]
+	return m, found, nil
+}
+
+func (s *uidgidStore) Set(path string, st os.FileInfo, m Meta) error {
+	defer s.invalidate(filepath.Dir(path))
+	return addUidGid(filepath.Dir(path), filepath.Base(path), m)
+}
+
+func (s *uidgidStore) Delete(path string, st os.FileInfo) error {
+	defer s.invalidate(filepath.Dir(path))
+	return removeUidGid(filepath.Dir(path), filepath.Base(path))
+}
+
+func (s *uidgidStore) Rename(oldpath, newpath string, st os.FileInfo) error {
+
+	olddir, oldname := filepath.Split(oldpath)
+	newdir, newname := filepath.Split(newpath)
+	olddir, newdir = filepath.Clean(olddir), filepath.Clean(newdir)
+	defer s.invalidate(olddir)
+	defer s.invalidate(newdir)
+
+	entries, err := readUidGid(olddir)
+	if err != nil {
+		return err
+	}
+	m, found := entries[oldname]
+
+	if olddir == newdir {
+		delete(entries, oldname)
+		delete(entries, newname)
+		if found {
+			entries[newname] = m
+		}
+		return writeUidGid(olddir, entries)
+	}
+
+	// A file with no Meta mustn't pick up a stale line for its new name.
+	if !found {
+		return removeUidGid(newdir, newname)
+	}
+	if err = addUidGid(newdir, newname, m); err != nil {
+		return err
+	}
+	return removeUidGid(olddir, oldname)
+}
+
+// Read the .uidgid file in dir.  A missing file has no entries.
+func readUidGid(dir string) (map[string]Meta, error) {
+
+	entries := make(map[string]Meta)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, uidgidFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return entries, nil
+		}
+		return nil, err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		// Malformed lines are skipped (and dropped on the next
+		// rewrite), as is any line for the .uidgid file itself.
+		columns := strings.Split(line, ":")
+		if columns[0] == uidgidFile {
+			continue
+		}
+
+		m, err := parseMeta(columns[1:])
+		if err != nil {
+			continue
+		}
+
+		entries[columns[0]] = m
+	}
+
+	return entries, nil
+}
+
+// Replace the .uidgid file in dir with entries, less any for files
+// that no longer exist or whose names can't be written.  If nothing
+// is left, the file is removed.
+func writeUidGid(dir string, entries map[string]Meta) error {
+
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		if strings.ContainsAny(name, badUidGidChars) {
+			continue
+		}
+		if _, err := os.Lstat(filepath.Join(dir, name)); err == nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	fn := filepath.Join(dir, uidgidFile)
+
+	if len(names) == 0 {
+		err := os.Remove(fn)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&buf, "%s:%s\n", name, strings.Join(entries[name].columns(), ":"))
+	}
+
+	tmp, err := ioutil.TempFile(dir, uidgidFile)
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(buf.Bytes())
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = tmp.Chmod(0600)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), fn)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+
+	return err
+}
+
+// Characters that can't be in a name in a .uidgid file: a name with
+// them in it would be read back as the line for some other file.
+const badUidGidChars = ":\n"
+
+var Ebadname = &p.Error{Err: "file name contains ':' or newline", Errornum: p.EINVAL}
+
+// Record the owner and group of a file in its directory.  The caller
+// holds the lock on dir.
+func addUidGid(dir, file string, m Meta) error {
+
+	if strings.ContainsAny(file, badUidGidChars) {
+		return Ebadname
+	}
+
+	entries, err := readUidGid(dir)
+	if err != nil {
+		return err
+	}
+
+	entries[file] = m
+
+	return writeUidGid(dir, entries)
+}
+
+// Forget the owner and group of a file that has been removed (or
+// renamed).  The caller holds the lock on dir.
+func removeUidGid(dir, file string) error {
+
+	entries, err := readUidGid(dir)
+	if err != nil {
+		return err
+	}
+
+	if _, found := entries[file]; !found {
+		return nil
+	}
+	delete(entries, file)
+
+	return writeUidGid(dir, entries)
+}
@@ -8,6 +8,8 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strconv"
 	"testing"
 )
 
@@ -41,7 +43,7 @@ func TestAdmIsDefaultOwner(t *testing.T) {
 
 	}
 
-	user, group, err := path2UserGroup(rootdir + "/t.txt", users)
+	user, group, err := new(VuFs).path2UserGroup(rootdir + "/t.txt", nil, users)
 	if err != nil {
 		t.Errorf("path2UserGroup(t.txt): err = %v\n", err)
 
@@ -89,7 +91,7 @@ func TestUidGidHasEntry(t *testing.T) {
 
 	}
 
-	user, group, err := path2UserGroup(rootdir + "/t.txt", users)
+	user, group, err := new(VuFs).path2UserGroup(rootdir + "/t.txt", nil, users)
 	if err != nil {
 		t.Errorf("path2UserGroup(%s): err = %v\n", rootdir + "/t.txt", err)
 
@@ -104,3 +106,379 @@ func TestUidGidHasEntry(t *testing.T) {
 	}
 }
 
+func TestOwnerFollowsRename(t *testing.T) {
+
+	err := os.RemoveAll(rootdir)
+	if err != nil {
+		t.Errorf("RemoveAll(%s): %v\n", rootdir, err)
+	}
+
+	d := rootdir + "/" + filepath.Dir(usersFile)
+	err = os.MkdirAll(d, 0755)
+	if err != nil {
+		t.Fatalf("MkdirAll(%s): %v\n", d, err)
+	}
+	defer os.RemoveAll(rootdir)
+
+	fn := rootdir + "/" + usersFile
+	err = ioutil.WriteFile(fn, []byte("1:adm:\n2:mark:\n3:nuts:\n"), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile(%s): err = %v\n", fn, err)
+	}
+
+	uidgid := []byte("t.txt:2:3\n")
+	err = ioutil.WriteFile(rootdir+"/"+uidgidFile, uidgid, 0644)
+	if err != nil {
+		t.Fatalf("WriteFile(%s): err = %v\n", rootdir+"/"+uidgidFile, err)
+	}
+
+	users, err := NewVusers(rootdir)
+	if err != nil {
+		t.Fatalf("NewVusers(%s): %v\n", rootdir, err)
+	}
+
+	if err = users.Rename("mark", "marc"); err != nil {
+		t.Fatalf("Rename(mark, marc): %v\n", err)
+	}
+
+	user, _, err := new(VuFs).path2UserGroup(rootdir+"/t.txt", nil, users)
+	if err != nil {
+		t.Errorf("path2UserGroup(%s): err = %v\n", rootdir+"/t.txt", err)
+	}
+	if user != "marc" {
+		t.Errorf("user: '%s' != 'marc'\n", user)
+	}
+
+	data, err := ioutil.ReadFile(rootdir + "/" + uidgidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(uidgid) {
+		t.Errorf("rename changed %s to '%s'\n", uidgidFile, data)
+	}
+}
+
+func TestNewFileGidFallback(t *testing.T) {
+
+	err := os.RemoveAll(rootdir)
+	if err != nil {
+		t.Errorf("RemoveAll(%s): %v\n", rootdir, err)
+	}
+
+	d := rootdir + "/" + filepath.Dir(usersFile)
+	err = os.MkdirAll(d, 0755)
+	if err != nil {
+		t.Fatalf("MkdirAll(%s): %v\n", d, err)
+	}
+	defer os.RemoveAll(rootdir)
+
+	fn := rootdir + "/" + usersFile
+	err = ioutil.WriteFile(fn, []byte("1:adm:\n2:mark:\n3:nuts:\n"), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile(%s): err = %v\n", fn, err)
+	}
+
+	// Group 9 was deleted from adm/users.
+	err = ioutil.WriteFile(rootdir+"/"+uidgidFile, []byte("gone:2:9\nnuts:2:3\n"), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile(%s): err = %v\n", rootdir+"/"+uidgidFile, err)
+	}
+
+	users, err := NewVusers(rootdir)
+	if err != nil {
+		t.Fatalf("NewVusers(%s): %v\n", rootdir, err)
+	}
+	mark := users.Uname2User("mark")
+
+	if gid := new(VuFs).newFileGid(rootdir+"/nuts", mark, users); gid != 3 {
+		t.Errorf("gid in directory nuts: %d != 3\n", gid)
+	}
+
+	if gid := new(VuFs).newFileGid(rootdir+"/gone", mark, users); gid != mark.Id() {
+		t.Errorf("gid in directory gone: %d != %d\n", gid, mark.Id())
+	}
+}
+
+func TestUidGidCompacted(t *testing.T) {
+
+	err := os.RemoveAll(rootdir)
+	if err != nil {
+		t.Errorf("RemoveAll(%s): %v\n", rootdir, err)
+	}
+
+	err = os.MkdirAll(rootdir, 0755)
+	if err != nil {
+		t.Fatalf("MkdirAll(%s): %v\n", rootdir, err)
+	}
+	defer os.RemoveAll(rootdir)
+
+	for _, fn := range []string{"a", "b"} {
+		err = ioutil.WriteFile(rootdir+"/"+fn, []byte{}, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Duplicates, a bad line and an entry for a file that's gone.
+	err = ioutil.WriteFile(rootdir+"/"+uidgidFile,
+		[]byte("a:2:3\nb:2:2\ngone:4:4\nbad:x:1\na:3:3\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := readUidGid(rootdir)
+	if err != nil {
+		t.Fatalf("readUidGid(): %v\n", err)
+	}
+	if !reflect.DeepEqual(entries["a"], Meta{Uid: 3, Gid: 3, Muid: 3}) {
+		t.Errorf("last line for a didn't win: %v\n", entries["a"])
+	}
+
+	err = writeUidGid(rootdir, entries)
+	if err != nil {
+		t.Fatalf("writeUidGid(): %v\n", err)
+	}
+
+	data, err := ioutil.ReadFile(rootdir + "/" + uidgidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "a:3:3\nb:2:2\n" {
+		t.Errorf("wrong %s after rewrite:\n%s\n", uidgidFile, data)
+	}
+
+	// No temporary files are left behind.
+	names, _ := filepath.Glob(rootdir + "/" + uidgidFile + "*")
+	if len(names) != 1 {
+		t.Errorf("expected only %s, found %v\n", uidgidFile, names)
+	}
+
+	os.Remove(rootdir + "/a")
+	err = removeUidGid(rootdir, "a")
+	if err != nil {
+		t.Fatalf("removeUidGid(): %v\n", err)
+	}
+	data, _ = ioutil.ReadFile(rootdir + "/" + uidgidFile)
+	if string(data) != "b:2:2\n" {
+		t.Errorf("wrong %s after remove:\n%s\n", uidgidFile, data)
+	}
+}
+
+func TestUidGidBadName(t *testing.T) {
+
+	err := os.MkdirAll(rootdir, 0755)
+	if err != nil {
+		t.Fatalf("MkdirAll(%s): %v\n", rootdir, err)
+	}
+	defer os.RemoveAll(rootdir)
+
+	// A file made on the host whose name looks like a line for victim.
+	bad := "victim:1:1"
+	for _, fn := range []string{"victim", bad} {
+		if err = ioutil.WriteFile(rootdir+"/"+fn, []byte{}, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = addUidGid(rootdir, "victim", Meta{Uid: 2, Gid: 2, Muid: 2}); err != nil {
+		t.Fatalf("addUidGid(victim): %v\n", err)
+	}
+	if err = addUidGid(rootdir, bad, Meta{Uid: 3, Gid: 3, Muid: 3}); err != Ebadname {
+		t.Errorf("addUidGid(%s) = %v, not Ebadname\n", bad, err)
+	}
+	if err = writeUidGid(rootdir, map[string]Meta{"victim": {Uid: 2, Gid: 2, Muid: 2}, bad: {Uid: 3, Gid: 3, Muid: 3}}); err != nil {
+		t.Fatalf("writeUidGid(): %v\n", err)
+	}
+
+	entries, _ := readUidGid(rootdir)
+	if m := entries["victim"]; m.Uid != 2 || m.Gid != 2 {
+		t.Errorf("victim now belongs to %d:%d\n", m.Uid, m.Gid)
+	}
+}
+
+func TestUidGidCache(t *testing.T) {
+
+	root, _ := scratchRoot(t)
+	defer os.RemoveAll(root)
+
+	s := new(uidgidStore)
+	a := filepath.Join(root, "a")
+	fn := filepath.Join(root, uidgidFile)
+
+	get := func(expected Meta) {
+		m, found, err := s.Get(a, nil)
+		if err != nil || !found || !reflect.DeepEqual(m, expected) {
+			t.Errorf("Get(a) = %v, %v, %v; expected %v\n", m, found, err, expected)
+		}
+	}
+
+	if err := s.Set(a, nil, Meta{Uid: 2, Gid: 3, Muid: 2}); err != nil {
+		t.Fatalf("Set(a): %v\n", err)
+	}
+	get(Meta{Uid: 2, Gid: 3, Muid: 2})
+	if len(s.dirs) != 1 {
+		t.Errorf("%s not cached\n", root)
+	}
+
+	// Our own writes.
+	if err := s.Set(a, nil, Meta{Uid: 3, Gid: 3, Muid: 3}); err != nil {
+		t.Fatalf("Set(a): %v\n", err)
+	}
+	get(Meta{Uid: 3, Gid: 3, Muid: 3})
+
+	// Edits in place, and replacements, by someone else.  (The
+	// edit in place changes the size; the mtime may not change.)
+	if err := ioutil.WriteFile(fn, []byte("a:2:2\n#\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	get(Meta{Uid: 2, Gid: 2, Muid: 2})
+
+	tmp := fn + ".new"
+	if err := ioutil.WriteFile(tmp, []byte("a:3:2\n#\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, fn); err != nil {
+		t.Fatal(err)
+	}
+	get(Meta{Uid: 3, Gid: 2, Muid: 3})
+
+	os.Remove(fn)
+	if _, found, _ := s.Get(a, nil); found {
+		t.Errorf("a still has an owner after %s was removed\n", uidgidFile)
+	}
+}
+
+// A store that reads the .uidgid file every time, as vufs did before
+// it cached them.
+type uncachedUidGid struct{ uidgidStore }
+
+func (*uncachedUidGid) Get(path string, st os.FileInfo) (Meta, bool, error) {
+	entries, err := readUidGid(filepath.Dir(path))
+	m, found := entries[filepath.Base(path)]
+	return m, found, err
+}
+
+// A root with a large directory, big, of files owned by mark, and a
+// path eight directories deep, d/d/.../d.
+func benchRoot(b *testing.B) (string, *vUsers) {
+
+	root, err := ioutil.TempDir("", "vufs")
+	if err != nil {
+		b.Fatal(err)
+	}
+	os.MkdirAll(filepath.Join(root, "adm"), 0755)
+	ioutil.WriteFile(filepath.Join(root, usersFile), []byte("1:adm:\n2:mark:\n3:nuts:\n"), 0644)
+
+	big := filepath.Join(root, "big")
+	os.Mkdir(big, 0755)
+	entries := make(map[string]Meta)
+	for i := 0; i < 1000; i++ {
+		fn := strconv.Itoa(i)
+		ioutil.WriteFile(filepath.Join(big, fn), []byte{}, 0644)
+		entries[fn] = Meta{Uid: 2, Gid: 3, Muid: 2}
+	}
+	writeUidGid(big, entries)
+
+	s := NewUidGidStore()
+
+	d := root
+	for i := 0; i < 8; i++ {
+		d = filepath.Join(d, "d")
+		os.Mkdir(d, 0755)
+		s.Set(d, nil, Meta{Uid: 2, Gid: 3, Muid: 2})
+	}
+
+	users, err := NewVusers(root)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return root, users
+}
+
+// Stat: the Dir of one file.  0.004 milliseconds cached, 0.3 uncached.
+func benchmarkStat(b *testing.B, store MetaStore) {
+	root, users := benchRoot(b)
+	defer os.RemoveAll(root)
+	fs := &VuFs{Root: root, Meta: store}
+	fn := filepath.Join(root, "big", "500")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		st, _ := os.Stat(fn)
+		if _, err := fs.dir2Dir(fn, st, users); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkStatCached(b *testing.B)   { benchmarkStat(b, nil) }
+func BenchmarkStatUncached(b *testing.B) { benchmarkStat(b, &uncachedUidGid{}) }
+
+// Walk: the Dir of each directory along d/d/.../d, for the permission
+// checks.  0.03 milliseconds cached, 0.07 uncached.
+func benchmarkWalk(b *testing.B, store MetaStore) {
+	root, users := benchRoot(b)
+	defer os.RemoveAll(root)
+	fs := &VuFs{Root: root, Meta: store}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		path := root
+		for j := 0; j < 8; j++ {
+			path += "/d"
+			st, _ := os.Stat(path)
+			if _, err := fs.dir2Dir(path, st, users); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkWalkCached(b *testing.B)   { benchmarkWalk(b, nil) }
+func BenchmarkWalkUncached(b *testing.B) { benchmarkWalk(b, &uncachedUidGid{}) }
+
+// Reading a directory of 1000 files.  5 milliseconds cached, 400
+// uncached.
+func benchmarkReadBigDir(b *testing.B, store MetaStore) {
+	root, users := benchRoot(b)
+	defer os.RemoveAll(root)
+	fs := &VuFs{Root: root, Meta: store}
+	big := filepath.Join(root, "big")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f, _ := os.Open(big)
+		dirs, _ := f.Readdir(-1)
+		f.Close()
+		for _, st := range dirs {
+			if _, err := fs.dir2Dir(big+"/"+st.Name(), st, users); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkReadBigDirCached(b *testing.B)   { benchmarkReadBigDir(b, nil) }
+func BenchmarkReadBigDirUncached(b *testing.B) { benchmarkReadBigDir(b, &uncachedUidGid{}) }
+
+func TestUidGidRename(t *testing.T) {
+
+	root, _ := scratchRoot(t)
+	defer os.RemoveAll(root)
+	os.Mkdir(filepath.Join(root, "d"), 0755)
+
+	s := new(uidgidStore)
+	a, b, c := filepath.Join(root, "a"), filepath.Join(root, "b"), filepath.Join(root, "d", "c")
+	m := Meta{Uid: 2, Gid: 3, Muid: 1, Mode: 0x40000000}
+	s.Set(a, nil, m)
+
+	// In a directory, and from one to another.
+	for _, move := range [][2]string{{a, b}, {b, c}} {
+		os.Rename(move[0], move[1])
+		if err := s.Rename(move[0], move[1], nil); err != nil {
+			t.Fatalf("Rename(%s, %s): %v\n", move[0], move[1], err)
+		}
+		if got, found, _ := s.Get(move[1], nil); !found || !reflect.DeepEqual(got, m) {
+			t.Errorf("%s after rename: %v, %v; expected %v\n", move[1], got, found, m)
+		}
+		if _, found, _ := s.Get(move[0], nil); found {
+			t.Errorf("%s still has Meta after rename\n", move[0])
+		}
+	}
+}
@@ -3,12 +3,10 @@ package vufs
 import (
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"os"
 	"path"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -19,19 +17,63 @@ import (
 
 const uidgidFile = ".uidgid"
 
+// The attach name for the admin view of the tree, in which adm (and
+// members of group adm) can see and read vufs' own metadata files.
+const adminAname = "adm"
+
+// The user that anyone can attach as.  As in Plan 9, none only
+// ever gets the "other" permissions on a file.
+const noneUser = "none"
+
 type Fid struct {
 	path string
 	file *os.File
+	// Contents of a synthetic file, as of when it was opened.
+	data []byte
+	// Attached to the admin view.
+	admin bool
+	// Opened with DMAPPEND set, so writes go at the end.
+	append bool
 }
 
 type VuFs struct {
 	srv.Srv
 	Root string
+	// If set, user none is confined to this directory (relative
+	// to Root) and may not change anything in it.
+	NoneRoot string
+
+	// Where file ownership is kept; if nil, in .uidgid files.
+	Meta MetaStore
+	// The .uidgid store used when Meta is nil.
+	uidgids uidgidStore
+
+	// Who owns files with no recorded owner, and, for OwnDefault,
+	// the owner and group they get (adm if empty).
+	Untracked    OwnerPolicy
+	DefaultOwner string
+	DefaultGroup string
+	// The owner and group of Root (adm if empty).
+	RootOwner string
+	RootGroup string
+
+	sessions sessions
+	// Serializes changes to the ownership files in each directory.
+	dirs dirLocks
+	// Serializes changes to the size of each file, by device and
+	// inode, so that quotas count each change once.
+	files dirLocks
+	// Space used by each user and group, once EnableQuotas is called.
+	quotas quotas
 }
 
 func toError(err error) *p.Error {
 	var ecode uint32
 
+	if e, ok := err.(*p.Error); ok {
+		return e
+	}
+
 	ename := err.Error()
 	if e, ok := err.(syscall.Errno); ok {
 		ecode = uint32(e)
@@ -104,79 +146,7 @@ func dir2Npmode(d os.FileInfo) uint32 {
 	return ret
 }
 
-// Convert a string user id to a string and look up user Name.
-func uid2name(id string, upool p.Users) (string, error) {
-
-	uid, err := strconv.Atoi(id)
-
-	if err != nil {
-		return "", fmt.Errorf("invalid uid '%s'", id)
-	}
-
-	u := upool.Uid2User(uid)
-
-	if u == nil {
-		return "", fmt.Errorf("no user with id %d", uid)
-	}
-
-	return u.Name(), nil
-
-}
-
-// Lookup (uid, gid) for a file (path = full path to file, e.g. './tmpfs/test.txt')
-func path2UserGroup(path string, upool p.Users) (string, string, error) {
-
-	// Default owner/group is adm.
-	user := "adm"
-	group := "adm"
-
-	dn := filepath.Dir(path)
-	fn := filepath.Base(path)
-
-	data, err := ioutil.ReadFile(filepath.Join(dn, uidgidFile))
-	if err != nil {
-		if os.IsNotExist(err) {
-			return user, group, nil
-		} else {
-			return "", "", err
-		}
-	}
-
-	sdata := string(data)
-
-	for _, line := range strings.Split(sdata, "\n") {
-
-		if line == "#" {
-			continue
-		}
-
-		columns := strings.Split(line, ":")
-		if len(columns) != 3 {
-			continue
-		}
-
-		if columns[0] == fn {
-
-			user, err = uid2name(columns[1], upool)
-
-			if err != nil {
-				return "", "", err
-			}
-
-			group, err = uid2name(columns[2], upool)
-
-			if err != nil {
-				return "", "", err
-			}
-
-			break
-		}
-	}
-
-	return user, group, nil
-}
-
-func dir2Dir(s string, d os.FileInfo, upool p.Users) (*p.Dir, error) {
+func (u *VuFs) dir2Dir(s string, d os.FileInfo, upool p.Users) (*p.Dir, error) {
 	sysif := d.Sys()
 	if sysif == nil {
 		return nil, &os.PathError{"dir2Dir", s, nil}
@@ -189,19 +159,21 @@ func dir2Dir(s string, d os.FileInfo, upool p.Users) (*p.Dir, error) {
 		return nil, &os.PathError{"dir2Dir: sysif has wrong type", s, nil}
 	}
 
+	mode := u.metaMode(s, d)
 	dir := new(p.Dir)
 	dir.Qid = *dir2Qid(d)
-	dir.Mode = dir2Npmode(d)
+	dir.Qid.Type |= uint8(mode >> 24)
+	dir.Mode = dir2Npmode(d) | mode
 	dir.Atime = uint32(atime(sysMode).Unix())
 	dir.Mtime = uint32(d.ModTime().Unix())
 	dir.Length = uint64(d.Size())
 	dir.Name = s[strings.LastIndex(s, "/")+1:]
 
-	uid, gid, err := path2UserGroup(s, upool)
+	uid, gid, muid, err := u.path2Users(s, d, upool)
 	if err != nil {
 		return nil, err
 	}
-	dir.Uid, dir.Gid = uid, gid
+	dir.Uid, dir.Gid, dir.Muid = uid, gid, muid
 
 	return dir, nil
 }
@@ -230,7 +202,7 @@ func mode2Perm(mode uint8) uint32 {
 // of DMREAD, DMWRITE, and DMEXEC.
 func CheckPerm(f *p.Dir, user p.User, perm uint32) bool {
 
-	if user == nil {
+	if user == nil || isDisabled(user) {
 		return false
 	}
 
@@ -243,8 +215,13 @@ func CheckPerm(f *p.Dir, user p.User, perm uint32) bool {
 		return true
 	}
 
+	/* none gets nothing more, whatever groups it is in */
+	if user.Name() == noneUser {
+		return false
+	}
+
 	/* user permissions */
-	if f.Uid == user.Name() || f.Uidnum == uint32(user.Id()) {
+	if f.Uid == user.Name() {
 		fperm |= (f.Mode >> 6) & 7
 	}
 
@@ -253,11 +230,11 @@ func CheckPerm(f *p.Dir, user p.User, perm uint32) bool {
 		return true
 	}
 
-	/* group permissions */
-	groups := user.Groups()
+	/* group permissions, including groups of groups */
+	groups := allGroups(user)
 	if groups != nil && len(groups) > 0 {
 		for i := 0; i < len(groups); i++ {
-			if f.Gid == groups[i].Name() || f.Gidnum == uint32(groups[i].Id()) {
+			if f.Gid == groups[i].Name() {
 				fperm |= (f.Mode >> 3) & 7
 				break
 			}
@@ -272,19 +249,44 @@ func CheckPerm(f *p.Dir, user p.User, perm uint32) bool {
 	return false
 }
 
-func (*VuFs) ConnOpened(conn *srv.Conn) {
+// The groups user is in, including groups of groups.
+func allGroups(user p.User) []p.Group {
+	if nested, ok := user.(interface {
+		AllGroups() []p.Group
+	}); ok {
+		return nested.AllGroups()
+	}
+	return user.Groups()
+}
+
+// The directory a user attaches to and can't walk above.
+func (u *VuFs) rootFor(user p.User) string {
+	if u.NoneRoot != "" && user != nil && user.Name() == noneUser {
+		return filepath.Join(u.Root, filepath.Join("/", u.NoneRoot))
+	}
+	return u.Root
+}
+
+// True if user may not change anything in the file system.
+func (u *VuFs) readOnly(user p.User) bool {
+	return u.NoneRoot != "" && user != nil && user.Name() == noneUser
+}
+
+func (u *VuFs) ConnOpened(conn *srv.Conn) {
 	if conn.Srv.Debuglevel > 0 {
 		log.Println("connected")
 	}
+	u.connected(conn)
 }
 
-func (*VuFs) ConnClosed(conn *srv.Conn) {
+func (u *VuFs) ConnClosed(conn *srv.Conn) {
 	if conn.Srv.Debuglevel > 0 {
 		log.Println("disconnected")
 	}
+	u.closed(conn)
 }
 
-func (*VuFs) FidDestroy(sfid *srv.Fid) {
+func (u *VuFs) FidDestroy(sfid *srv.Fid) {
 	var fid *Fid
 
 	if sfid.Aux == nil {
@@ -292,30 +294,48 @@ func (*VuFs) FidDestroy(sfid *srv.Fid) {
 	}
 
 	fid = sfid.Aux.(*Fid)
-	if fid != nil {
+	if fid != nil && fid.file != nil {
 		fid.file.Close()
+		u.unopened(sfid.Fconn)
 	}
 }
 
-// Always attach to the VuFs root.
+// Always attach to the VuFs root, except that none attaches to
+// NoneRoot if one is set.  No authentication is done, so none (like
+// every other user) can always attach.  Attaching to adminAname gives
+// administrators the admin view of the root.
 func (u *VuFs) Attach(req *srv.Req) {
 
-	if req.Tc.Aname != "/" && req.Tc.Aname != "" {
+	admin := req.Tc.Aname == adminAname
+	if req.Tc.Aname != "/" && req.Tc.Aname != "" && !admin {
 		req.RespondError(srv.Eperm)
 		return
 	}
 
-	st, err := os.Stat(u.Root)
+	if admin && !isAdmin(req.Fid.User, req.Conn.Srv.Upool) {
+		req.RespondError(srv.Eperm)
+		return
+	}
+
+	if isDisabled(req.Fid.User) {
+		req.RespondError(Edisabled)
+		return
+	}
+
+	root := u.rootFor(req.Fid.User)
+	st, err := os.Stat(root)
 	if err != nil {
 		req.RespondError(toError(err))
 		return
 	}
 
 	fid := new(Fid)
-	fid.path = u.Root
+	fid.path = root
+	fid.admin = admin
 	req.Fid.Aux = fid
+	u.attached(req.Conn, req.Fid.User)
 
-	qid := dir2Qid(st)
+	qid := u.path2Qid(root, st)
 	req.RespondRattach(qid)
 }
 
@@ -332,19 +352,33 @@ func (u *VuFs) Walk(req *srv.Req) {
 	fid := req.Fid.Aux.(*Fid)
 	tc := req.Tc
 
+	if req.Newfid.Aux == nil {
+		req.Newfid.Aux = new(Fid)
+	}
+
+	newfid := req.Newfid.Aux.(*Fid)
+	newfid.admin = fid.admin
+
+	// Synthetic files can only be cloned.
+	if u.synthAt(fid.path) != nil {
+		if len(tc.Wname) > 0 {
+			req.RespondError(srv.Enotdir)
+			return
+		}
+		newfid.path = fid.path
+		req.RespondRwalk(nil)
+		return
+	}
+
 	_, err := os.Stat(fid.path)
 	if err != nil {
 		req.RespondError(toError(err))
 		return
 	}
 
-	if req.Newfid.Aux == nil {
-		req.Newfid.Aux = new(Fid)
-	}
-
-	newfid := req.Newfid.Aux.(*Fid)
 	wqids := make([]p.Qid, len(tc.Wname))
 	path := fid.path
+	root := u.rootFor(req.Fid.User)
 	i := 0
 
 	// Ensure execute permission on the walk root.
@@ -353,12 +387,12 @@ func (u *VuFs) Walk(req *srv.Req) {
 		req.RespondError(srv.Enoent)
 		return
 	}
-	f, err := dir2Dir(path, st, req.Conn.Srv.Upool)
+	f, err := u.dir2Dir(path, st, req.Conn.Srv.Upool)
 	if err != nil {
 		req.RespondError(toError(err))
 		return
 	}
-	if !CheckPerm(f, req.Fid.User, p.DMEXEC) {
+	if !u.checkPerm(path, f, req.Fid.User, p.DMEXEC) {
 		req.RespondError(srv.Eperm)
 		return
 	}
@@ -369,11 +403,11 @@ func (u *VuFs) Walk(req *srv.Req) {
 
 		// Don't allow client to dotdot out of the file system root.
 		if tc.Wname[i] == ".." {
-			if path == u.Root {
+			if path == root {
 				continue
 			} else {
 				newpath = path[:strings.LastIndex(path, "/")]
-				if newpath == u.Root {
+				if newpath == root {
 					continue
 				}
 			}
@@ -381,6 +415,27 @@ func (u *VuFs) Walk(req *srv.Req) {
 			newpath = path + "/" + tc.Wname[i]
 		}
 
+		// Metadata files don't exist outside the admin view, nor
+		// other users' files in a drop box.
+		if (u.isMetaFile(newpath) && !fid.admin) || (tc.Wname[i] != ".." &&
+			u.onlyOwn(path, req.Fid.User, req.Conn.Srv.Upool) &&
+			!u.owns(req.Fid.User, newpath, req.Conn.Srv.Upool)) {
+			if i == 0 {
+				req.RespondError(srv.Enoent)
+				return
+			}
+			break
+		}
+
+		if sf := u.synthAt(newpath); sf != nil {
+			if _, err := os.Lstat(newpath); os.IsNotExist(err) {
+				wqids[i] = *sf.qid()
+				path = newpath
+				i++
+				break
+			}
+		}
+
 		st, err := os.Stat(newpath)
 		if err != nil {
 			if i == 0 {
@@ -391,15 +446,27 @@ func (u *VuFs) Walk(req *srv.Req) {
 			break
 		}
 
-		wqids[i] = *dir2Qid(st)
+		wqids[i] = *u.path2Qid(newpath, st)
+
+		// Untracked files and directories don't exist when access
+		// to them is denied.
+		if u.Untracked == OwnDeny {
+			if _, _, err := u.path2UserGroup(newpath, st, req.Conn.Srv.Upool); err == Euntracked {
+				if i == 0 {
+					req.RespondError(srv.Enoent)
+					return
+				}
+				break
+			}
+		}
 
 		if (wqids[i].Type & p.QTDIR) > 0 {
-			f, err := dir2Dir(newpath, st, req.Conn.Srv.Upool)
+			f, err := u.dir2Dir(newpath, st, req.Conn.Srv.Upool)
 			if err != nil {
 				req.RespondError(toError(err))
 				return
 			}
-			if !CheckPerm(f, req.Fid.User, p.DMEXEC) {
+			if !u.checkPerm(newpath, f, req.Fid.User, p.DMEXEC) {
 				req.RespondError(srv.Eperm)
 				return
 			}
@@ -416,106 +483,178 @@ func (u *VuFs) Open(req *srv.Req) {
 	fid := req.Fid.Aux.(*Fid)
 	tc := req.Tc
 
+	if sf := u.synthAt(fid.path); sf != nil {
+		u.synthOpen(req, sf)
+		return
+	}
+
 	// Ensure open permission.
 	st, err := os.Stat(fid.path)
 	if err != nil {
 		req.RespondError(srv.Enoent)
 		return
 	}
-	f, err := dir2Dir(fid.path, st, req.Conn.Srv.Upool)
+	f, err := u.dir2Dir(fid.path, st, req.Conn.Srv.Upool)
 	if err != nil {
 		req.RespondError(toError(err))
 		return
 	}
-	if !CheckPerm(f, req.Fid.User, mode2Perm(tc.Mode)) {
+	if !u.checkPerm(fid.path, f, req.Fid.User, mode2Perm(tc.Mode)) {
+		req.RespondError(srv.Eperm)
+		return
+	}
+	if mode2Perm(tc.Mode)&p.DMWRITE != 0 && u.readOnly(req.Fid.User) {
 		req.RespondError(srv.Eperm)
 		return
 	}
 
+	// Even in the admin view, metadata files are read only.
+	if u.isMetaFile(fid.path) && (tc.Mode&3 != p.OREAD || tc.Mode&(p.OTRUNC|p.ORCLOSE) != 0) {
+		req.RespondError(srv.Eperm)
+		return
+	}
+
+	// Append-only files aren't truncated, and writes to them go to
+	// the end, even if the file grows on the host.
+	qid := u.path2Qid(fid.path, st)
+	fid.append = qid.Type&p.QTAPPEND != 0
+	flags := omode2uflags(tc.Mode)
+	if fid.append {
+		flags = flags&^os.O_TRUNC | os.O_APPEND
+	}
+
 	var e error
-	fid.file, e = os.OpenFile(fid.path, omode2uflags(tc.Mode), 0)
+	if flags&os.O_TRUNC != 0 {
+		unlock := u.lockFile(st)
+		var size int64
+		if now, err := os.Stat(fid.path); err == nil {
+			size = fileUsage(now).bytes
+		}
+		fid.file, e = os.OpenFile(fid.path, flags, 0)
+		if e == nil {
+			u.quotaAdd(fid.path, st, usage{-size, 0})
+		}
+		unlock()
+	} else {
+		fid.file, e = os.OpenFile(fid.path, flags, 0)
+	}
 	if e != nil {
 		req.RespondError(toError(e))
 		return
 	}
+	u.opened(req.Conn)
 
-	req.RespondRopen(dir2Qid(st), 0)
+	req.RespondRopen(qid, 0)
 }
 
-func addUidGid(dir, file string, uid, gid int, fid *srv.Fid) error {
-
-	fid.Lock()
-	defer fid.Unlock()
+// The group id for a file created in parentPath by user.  A new file
+// takes the group of its directory.  If that group can't be found
+// (for example, it was deleted from adm/users), the file gets the
+// creator's own group instead, and the fallback is logged.
+func (u *VuFs) newFileGid(parentPath string, user p.User, upool p.Users) int {
 
-	fn0 := dir + "/" + uidgidFile
-	//fn1 := fn0 + ".tmp"
-
-	fp0, err := os.OpenFile(fn0, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
-	if err != nil {
-		return err
-	}
-
-	defer fp0.Close()
-
-	_, err = fp0.WriteString(fmt.Sprintf("%s:%d:%d\n", file, uid, gid))
-	if err != nil {
-		// BUG(mbucc) Roll back  bytes written to .uidgid on error.
-		return err
-	}
-
-/*
-
-	fp0, err := os.OpenFile(fn0, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	_, dirgroup, err := u.path2UserGroup(parentPath, nil, upool)
 	if err == nil {
-		defer fp0.Close()
-		_, err = fp0.WriteString(fmt.Sprintf("%s:%s:%s\n", file, uid, uid))
-
-	switch err {
-	case nil:
-
-	if err == nil && os.IsNotExist(err){
-		return err
+		if g := upool.Gname2Group(dirgroup); g != nil {
+			return g.Id()
+		}
+		err = fmt.Errorf("no group named '%s'", dirgroup)
 	}
 
-	if err != nil {
-
-
-
+	log.Printf("create in %s: %v; using group %s\n", parentPath, err, user.Name())
 
-*/
-
-	return nil
+	return user.Id()
 }
 
-
-func (*VuFs) Create(req *srv.Req) {
+func (u *VuFs) Create(req *srv.Req) {
 	fid := req.Fid.Aux.(*Fid)
 	tc := req.Tc
 
 	parentPath := fid.path
 
+	if u.readOnly(req.Fid.User) {
+		req.RespondError(srv.Eperm)
+		return
+	}
+
+	if u.synthAt(parentPath+"/"+tc.Name) != nil || u.isMetaFile(parentPath+"/"+tc.Name) {
+		req.RespondError(srv.Eperm)
+		return
+	}
+	if strings.ContainsAny(tc.Name, badUidGidChars) {
+		req.RespondError(Ebadname)
+		return
+	}
+
 	// User must be able to write to parent directory.
 	st, err := os.Stat(parentPath)
 	if err != nil {
 		req.RespondError(toError(err))
 		return
 	}
-	f, err := dir2Dir(parentPath, st, req.Conn.Srv.Upool)
+	f, err := u.dir2Dir(parentPath, st, req.Conn.Srv.Upool)
 	if err != nil {
 		req.RespondError(toError(err))
 		return
 	}
-	if !CheckPerm(f, req.Fid.User, p.DMWRITE) {
+	if !u.checkPerm(parentPath, f, req.Fid.User, p.DMWRITE) {
 		req.RespondError(srv.Eperm)
 		return
 	}
 
+	unlock := u.dirs.lock(parentPath)
+	defer unlock()
+
+	// The directory's defaults, if it has any, override the
+	// permissions and group the client asks for.
+	perm := tc.Perm
+	defaults := u.dirDefaults(parentPath)
+	if defaults != nil {
+		perm = defaults.perm(perm)
+	}
+
+	// As in Plan 9, a name that is taken can't be created.  In a drop
+	// box, a name taken by someone else's (hidden) file is refused
+	// without saying so.
 	path := parentPath + "/" + tc.Name
+	if _, err := os.Lstat(path); err == nil {
+		if u.onlyOwn(parentPath, req.Fid.User, req.Conn.Srv.Upool) &&
+			!u.owns(req.Fid.User, path, req.Conn.Srv.Upool) {
+			req.RespondError(srv.Eperm)
+		} else {
+			req.RespondError(srv.Eexist)
+		}
+		return
+	}
+
+	m := Meta{
+		Uid:  req.Fid.User.Id(),
+		Muid: req.Fid.User.Id(),
+		Mode: perm & metaModeBits,
+	}
+	if defaults != nil && defaults.Gid != NoGid {
+		m.Gid = defaults.Gid
+	} else {
+		m.Gid = u.newFileGid(parentPath, req.Fid.User, req.Conn.Srv.Upool)
+	}
+	if tc.Perm&p.DMDIR != 0 {
+		m.Defaults = defaults
+	}
+
+	if err := u.quotaReserveIds(m.Uid, m.Gid, usage{0, 1}); err != nil {
+		req.RespondError(err)
+		return
+	}
+	fail := func(err error) {
+		u.quotaAddIds(m.Uid, m.Gid, usage{0, -1})
+		req.RespondError(err)
+	}
+
 	var e error = nil
 	var file *os.File = nil
 	switch {
 	case tc.Perm&p.DMDIR != 0:
-		e = os.Mkdir(path, os.FileMode(tc.Perm&0777))
+		e = os.Mkdir(path, os.FileMode(perm&0777))
 		if e == nil {
 			file, e = os.OpenFile(path, omode2uflags(tc.Mode), 0)
 		}
@@ -525,20 +664,27 @@ func (*VuFs) Create(req *srv.Req) {
 			tc.Perm&p.DMNAMEDPIPE != 0,
 			tc.Perm&p.DMDEVICE != 0,
 			tc.Perm&p.DMSOCKET != 0,
-			tc.Perm&p.DMSETUID != 0,
-			tc.Perm&p.DMSETGID != 0:
-		req.RespondError(srv.Ebaduse)
+			tc.Perm&dotuModeBits != 0 && !req.Conn.Dotu:
+		fail(srv.Ebaduse)
 		return
 
 	default:
-		var mode uint32 = tc.Perm & 0777
+		var mode uint32 = perm & 0777
 		file, e = os.OpenFile(path,
-			omode2uflags(tc.Mode)|os.O_CREATE,
+			omode2uflags(tc.Mode)|os.O_CREATE|os.O_EXCL,
 			os.FileMode(mode))
 	}
 
+	// Exactly the permissions the defaults give, whatever the
+	// host's umask.
+	if e == nil && defaults != nil {
+		if e = os.Chmod(path, os.FileMode(perm&0777)); e != nil {
+			file.Close()
+		}
+	}
+
 	if e != nil {
-		req.RespondError(toError(e))
+		fail(toError(e))
 		return
 	}
 
@@ -548,35 +694,36 @@ func (*VuFs) Create(req *srv.Req) {
 	if err != nil {
 		file.Close()
 		fid.file = nil
-		req.RespondError(err)
+		fail(err)
 		return
 	}
 
-	// BUG(mbucc): Redesign data structures so I can remove this panic.
-	_, dirgid, err := path2UserGroup(parentPath, req.Conn.Srv.Upool)
-	if err != nil {
-		panic(fmt.Sprintf("no uid/gid found for parent directory '%s'", parentPath))
-	}
-	gu := req.Conn.Srv.Upool.Uname2User(dirgid)
-	if gu == nil {
-		panic(fmt.Sprintf("no user for parent directory gid %d", dirgid))
-	}
-	
-	err = addUidGid(parentPath, tc.Name, req.Fid.User.Id(), gu.Id(), req.Fid)
+	err = u.meta().Set(path, st, m)
 	if err != nil {
 		file.Close()
 		fid.file = nil
-		req.RespondError(err)
+		fail(err)
 		return
 	}
+	// The file was reserved; a new one has no bytes, but count any.
+	u.quotaAddIds(m.Uid, m.Gid, usage{fileUsage(st).bytes, 0})
 
-	req.RespondRcreate(dir2Qid(st), 0)
+	u.opened(req.Conn)
+	qid := u.path2Qid(path, st)
+	fid.append = qid.Type&p.QTAPPEND != 0
+	req.RespondRcreate(qid, 0)
 }
 
 func (u *VuFs) Read(req *srv.Req) {
 	fid := req.Fid.Aux.(*Fid)
 	tc := req.Tc
 	rc := req.Rc
+
+	if sf := u.synthAt(fid.path); sf != nil {
+		u.synthRead(req, sf)
+		return
+	}
+
 	st, err := os.Stat(fid.path)
 	if err != nil {
 		req.RespondError(err)
@@ -604,16 +751,29 @@ func (u *VuFs) Read(req *srv.Req) {
 		// Estimate 49 + 20 + 20 + 20 + 11
 		// From ../../lionkov/go9p/p/p9.go:421,427
 		dirents := make([]byte, 0, 120 * len(dirs))
+		onlyOwn := u.onlyOwn(fid.path, req.Fid.User, req.Conn.Srv.Upool)
 		for i := 0; i < len(dirs); i++ {
 			path := fid.path + "/" + dirs[i].Name()
-			st, err := dir2Dir(path, dirs[i], req.Conn.Srv.Upool)
+			if u.isMetaFile(path) && !fid.admin {
+				continue
+			}
+			st, err := u.dir2Dir(path, dirs[i], req.Conn.Srv.Upool)
+			if err == Euntracked {
+				continue
+			}
 			if err != nil {
 				req.RespondError(toError(err))
 				return
 			}
+			if onlyOwn && st.Uid != req.Fid.User.Name() {
+				continue
+			}
 			b := p.PackDir(st, false)
 			dirents = append(dirents, b...)
 		}
+		for _, st := range u.synthDirs(fid.path) {
+			dirents = append(dirents, p.PackDir(st, false)...)
+		}
 
 		if len(dirents) > int(tc.Count) {
 			req.RespondError(srv.Etoolarge)
@@ -635,16 +795,70 @@ func (u *VuFs) Read(req *srv.Req) {
 	req.Respond()
 }
 
-func (*VuFs) Write(req *srv.Req) {
+func (u *VuFs) Write(req *srv.Req) {
 	fid := req.Fid.Aux.(*Fid)
 	tc := req.Tc
-	_, err := os.Stat(fid.path)
+
+	if sf := u.synthAt(fid.path); sf != nil {
+		u.synthWrite(req, sf)
+		return
+	}
+
+	st, err := os.Stat(fid.path)
 	if err != nil {
 		req.RespondError(toError(err))
 		return
 	}
 
-	n, e := fid.file.WriteAt(tc.Data, int64(tc.Offset))
+	if u.readOnly(req.Fid.User) {
+		req.RespondError(srv.Eperm)
+		return
+	}
+
+	// The size is read and changed under the file's lock, so that
+	// writes at once each count only what they add.
+	unlock := u.lockFile(st)
+	before, err := fid.file.Stat()
+	if err != nil {
+		unlock()
+		req.RespondError(toError(err))
+		return
+	}
+
+	// As in Plan 9, the offset is ignored for append-only files.
+	offset := int64(tc.Offset)
+	if fid.append {
+		offset = before.Size()
+	}
+
+	grow := offset + int64(len(tc.Data)) - before.Size()
+	if grow < 0 {
+		grow = 0
+	}
+	if grow > 0 {
+		if err := u.quotaReserve(fid.path, st, usage{grow, 0}); err != nil {
+			unlock()
+			req.RespondError(toError(err))
+			return
+		}
+	}
+
+	// Count what the file grew by, rather than what was reserved.
+	var n int
+	var e error
+	if fid.append {
+		n, e = appendTo(fid.file, tc.Data)
+	} else {
+		n, e = fid.file.WriteAt(tc.Data, offset)
+	}
+	grew := grow
+	if after, err := fid.file.Stat(); err == nil {
+		grew = after.Size() - before.Size()
+	}
+	if grew != grow {
+		u.quotaAdd(fid.path, st, usage{grew - grow, 0})
+	}
+	unlock()
 	if e != nil {
 		req.RespondError(toError(e))
 		return
@@ -653,27 +867,90 @@ func (*VuFs) Write(req *srv.Req) {
 	req.RespondRwrite(uint32(n))
 }
 
+// Write data to the end of f.  f is opened with O_APPEND, unless it
+// was just created, so the seek is for the latter.
+func appendTo(f *os.File, data []byte) (int, error) {
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		return 0, err
+	}
+	return f.Write(data)
+}
+
+// Lock the file st for a change to its size, and return a func that
+// unlocks it.
+func (u *VuFs) lockFile(st os.FileInfo) func() {
+	return u.files.lock(statID(st).String())
+}
+
 func (*VuFs) Clunk(req *srv.Req) { req.RespondRclunk() }
 
-func (*VuFs) Remove(req *srv.Req) {
+func (u *VuFs) Remove(req *srv.Req) {
 	fid := req.Fid.Aux.(*Fid)
-	_, err := os.Stat(fid.path)
+	st, err := os.Stat(fid.path)
 	if err != nil {
 		req.RespondError(toError(err))
 		return
 	}
 
+	if u.readOnly(req.Fid.User) || u.isMetaFile(fid.path) || fid.path == u.rootFor(req.Fid.User) ||
+		!u.mayUnlink(fid.path, req.Fid.User, req.Conn.Srv.Upool) {
+		req.RespondError(srv.Eperm)
+		return
+	}
+
+	// As for a rename, the user needs to be able to write the directory.
+	dir := filepath.Dir(fid.path)
+	dst, err := os.Stat(dir)
+	if err != nil {
+		req.RespondError(toError(err))
+		return
+	}
+	f, err := u.dir2Dir(dir, dst, req.Conn.Srv.Upool)
+	if err != nil {
+		req.RespondError(toError(err))
+		return
+	}
+	if !u.checkPerm(dir, f, req.Fid.User, p.DMWRITE) {
+		req.RespondError(srv.Eperm)
+		return
+	}
+
+	// The owners, for quotas, before the metadata goes.
+	var uid, gid int
+	if u.quotas.on {
+		if uid, gid, err = u.fileIds(fid.path, st); err != nil {
+			req.RespondError(toError(err))
+			return
+		}
+	}
+
+	unlock := u.dirs.lock(dir)
+	defer unlock()
+
 	e := os.Remove(fid.path)
 	if e != nil {
 		req.RespondError(toError(e))
 		return
 	}
+	d := fileUsage(st)
+	u.quotaAddIds(uid, gid, usage{-d.bytes, -d.files})
+
+	e = u.meta().Delete(fid.path, st)
+	if e != nil {
+		log.Printf("remove %s: %v\n", fid.path, e)
+	}
 
 	req.RespondRremove()
 }
 
-func (*VuFs) Stat(req *srv.Req) {
+func (u *VuFs) Stat(req *srv.Req) {
 	fid := req.Fid.Aux.(*Fid)
+
+	if sf := u.synthAt(fid.path); sf != nil {
+		req.RespondRstat(sf.dir())
+		return
+	}
+
 	st, err := os.Stat(fid.path)
 
 	if err != nil {
@@ -681,7 +958,7 @@ func (*VuFs) Stat(req *srv.Req) {
 		return
 	}
 
-	dir, err := dir2Dir(fid.path, st, req.Conn.Srv.Upool)
+	dir, err := u.dir2Dir(fid.path, st, req.Conn.Srv.Upool)
 	if err != nil {
 		req.RespondError(err)
 		return
@@ -689,72 +966,281 @@ func (*VuFs) Stat(req *srv.Req) {
 	req.RespondRstat(dir)
 }
 
+// The path a Wstat that sets the name to name would move oldpath to,
+// if the user may do that.  The user needs write permission on the
+// directory the file leaves and the one it goes to (the same, unless
+// name has a slash in it), and the new name must not be taken.
+func (u *VuFs) renameTarget(req *srv.Req, oldpath, name string) (string, error) {
+
+	root := u.rootFor(req.Fid.User)
+	if oldpath == root {
+		return "", srv.Eperm
+	}
+
+	// If we path.Join name to / before adding it to the directory,
+	// that ensures nobody gets to walk out of the root of this server.
+	newpath := path.Join(path.Dir(oldpath), path.Join("/", name))
+
+	// absolute renaming. VuFs can do this, so let's support it.
+	// We'll allow an absolute path in the Name and, if it is,
+	// we will make it relative to root. This is a gigantic performance
+	// improvement in systems that allow it.
+	if filepath.IsAbs(name) {
+		newpath = path.Join(root, path.Clean(name))
+	}
+
+	if newpath == oldpath {
+		return newpath, nil
+	}
+	if strings.ContainsAny(path.Base(newpath), badUidGidChars) {
+		return "", Ebadname
+	}
+
+	// Nothing moves into itself, onto the root, or onto vufs' files.
+	if newpath == root || strings.HasPrefix(newpath, oldpath+"/") ||
+		u.isMetaFile(newpath) || u.synthAt(newpath) != nil {
+		return "", srv.Eperm
+	}
+
+	if _, err := os.Lstat(newpath); err == nil {
+		return "", srv.Eexist
+	}
+
+	if !u.mayUnlink(oldpath, req.Fid.User, req.Conn.Srv.Upool) {
+		return "", srv.Eperm
+	}
+
+	for _, d := range []string{path.Dir(oldpath), path.Dir(newpath)} {
+		st, err := os.Stat(d)
+		if err != nil {
+			return "", toError(err)
+		}
+		f, err := u.dir2Dir(d, st, req.Conn.Srv.Upool)
+		if err != nil {
+			return "", toError(err)
+		}
+		if !u.checkPerm(d, f, req.Fid.User, p.DMWRITE) {
+			return "", srv.Eperm
+		}
+	}
+
+	return newpath, nil
+}
+
+// Rename a file and its metadata.  The caller holds the locks on both
+// directories.
+func (u *VuFs) rename(oldpath, newpath string) error {
+
+	// Someone may have taken the name since renameTarget looked.
+	if _, err := os.Lstat(newpath); err == nil {
+		return srv.Eexist
+	}
+
+	st, err := os.Lstat(oldpath)
+	if err != nil {
+		return toError(err)
+	}
+
+	if err = syscall.Rename(oldpath, newpath); err != nil {
+		return toError(err)
+	}
+
+	if err = u.meta().Rename(oldpath, newpath, st); err != nil {
+		// Put it back, rather than leave the file with no owner.
+		if e := syscall.Rename(newpath, oldpath); e != nil {
+			log.Printf("rename %s back from %s: %v\n", oldpath, newpath, e)
+		}
+		return toError(err)
+	}
+
+	return nil
+}
+
+// The id of the group named gname, if the user may give path, which is
+// st, that group.  As in Plan 9, the owner of a file may change its
+// group to one they are a member of; adm may change it to any group.
+// The new group must have room for the file.
+func (u *VuFs) chgrpTarget(req *srv.Req, path string, st os.FileInfo, gname string) (int, error) {
+
+	f, err := u.dir2Dir(path, st, req.Conn.Srv.Upool)
+	if err != nil {
+		return noId, err
+	}
+	g := req.Conn.Srv.Upool.Gname2Group(gname)
+	if g == nil {
+		return noId, srv.Enoent
+	}
+	if f.Gid == gname {
+		return noId, nil
+	}
+	if u.isRoot(path) {
+		return noId, srv.Eperm
+	}
+
+	user := req.Fid.User
+	if !isAdmin(user, req.Conn.Srv.Upool) {
+		member := false
+		for _, ug := range allGroups(user) {
+			member = member || ug.Id() == g.Id()
+		}
+		if f.Uid != user.Name() || !member || user.Name() == noneUser {
+			return noId, srv.Eperm
+		}
+	}
+
+	if err := u.quotaCheckIds(noId, g.Id(), fileUsage(st)); err != nil {
+		return noId, err
+	}
+	return g.Id(), nil
+}
+
+// Give path, which is st, the group gid.  The caller holds the lock on
+// its directory.
+func (u *VuFs) chgrp(path string, st os.FileInfo, gid int, upool p.Users) error {
+	_, oldgid, err := u.fileIds(path, st)
+	if err != nil {
+		return err
+	}
+	if err = u.quotaChgrp(oldgid, gid, fileUsage(st)); err != nil {
+		return err
+	}
+	err = u.changeMeta(path, st, upool, func(m *Meta) { m.Gid = gid })
+	if err != nil {
+		// Moving less than nothing can't go over a limit.
+		d := fileUsage(st)
+		u.quotaChgrp(oldgid, gid, usage{-d.bytes, -d.files})
+	}
+	return err
+}
+
+// True if the user may change the mode of path, which is st.  As in
+// Plan 9, only the owner of a file may; here adm may too.
+func (u *VuFs) mayChmod(req *srv.Req, path string, st os.FileInfo) bool {
+	if isAdmin(req.Fid.User, req.Conn.Srv.Upool) {
+		return true
+	}
+	owner, _, err := u.path2UserGroup(path, st, req.Conn.Srv.Upool)
+	return err == nil && owner == req.Fid.User.Name()
+}
+
 func (u *VuFs) Wstat(req *srv.Req) {
 	fid := req.Fid.Aux.(*Fid)
-	_, err := os.Stat(fid.path)
+	st, err := os.Stat(fid.path)
 	if err != nil {
 		req.RespondError(toError(err))
 		return
 	}
 
 	dir := &req.Tc.Dir
-	if dir.Mode != 0xFFFFFFFF {
-		mode := dir.Mode & 0777
-		e := os.Chmod(fid.path, os.FileMode(mode))
-		if e != nil {
-			req.RespondError(toError(e))
+
+	if u.readOnly(req.Fid.User) || u.isMetaFile(fid.path) {
+		req.RespondError(srv.Eperm)
+		return
+	}
+
+	// Check a rename before changing anything, so that a Wstat that
+	// can't rename changes nothing.
+	var newname string
+	if dir.Name != "" {
+		newname, err = u.renameTarget(req, fid.path, dir.Name)
+		if err != nil {
+			req.RespondError(err)
 			return
 		}
 	}
 
-/*
-	// BUG(mbucc) implement chown
-	uid, gid := p.NOUID, p.NOUID
-
-	uid, err = lookup(dir.Uid, false)
-	if err != nil {
-		req.RespondError(err)
-		return
+	// And a change of group, or one that would go over a quota.
+	gid := noId
+	if dir.Gid != "" {
+		gid, err = u.chgrpTarget(req, fid.path, st, dir.Gid)
+		if err != nil {
+			req.RespondError(toError(err))
+			return
+		}
 	}
-
-	gid, err = lookup(dir.Gid, true)
-	if err != nil {
-		req.RespondError(err)
-		return
+	// And a change of mode.  The bits vufs keeps (which a client
+	// that doesn't speak 9P2000.u can't see, and so leaves alone) go
+	// with the file's owner, which the root doesn't have.
+	var metamode uint32
+	if dir.Mode != 0xFFFFFFFF {
+		metamode = dir.Mode & metaModeBits
+		if !req.Conn.Dotu {
+			metamode = metamode&^dotuModeBits | u.metaMode(fid.path, st)&dotuModeBits
+		}
+		if !u.mayChmod(req, fid.path, st) || (u.isRoot(fid.path) && metamode != 0) {
+			req.RespondError(srv.Eperm)
+			return
+		}
+	}
+	if dir.Length != 0xFFFFFFFFFFFFFFFF && st.Mode().IsRegular() {
+		if grow := int64(dir.Length) - st.Size(); grow > 0 {
+			if err := u.quotaCheck(fid.path, st, usage{grow, 0}); err != nil {
+				req.RespondError(toError(err))
+				return
+			}
+		}
 	}
 
-	if uid != p.NOUID || gid != p.NOUID {
-		e := os.Chown(fid.path, int(uid), int(gid))
+	if dir.Mode != 0xFFFFFFFF {
+		unlock := u.dirs.lock(filepath.Dir(fid.path))
+		oldmode := u.metaMode(fid.path, st)
+		e := u.setMetaMode(fid.path, st, metamode, req.Conn.Srv.Upool)
+		if e == nil {
+			if e = os.Chmod(fid.path, os.FileMode(dir.Mode&0777)); e != nil {
+				u.setMetaMode(fid.path, st, oldmode, req.Conn.Srv.Upool)
+			}
+		}
+		unlock()
 		if e != nil {
 			req.RespondError(toError(e))
 			return
 		}
 	}
-*/
-	if dir.Name != "" {
-		// If we path.Join dir.Name to / before adding it to
-		// the fid path, that ensures nobody gets to walk out of the
-		// root of this server.
-		newname := path.Join(path.Dir(fid.path), path.Join("/", dir.Name))
 
-		// absolute renaming. VuFs can do this, so let's support it.
-		// We'll allow an absolute path in the Name and, if it is,
-		// we will make it relative to root. This is a gigantic performance
-		// improvement in systems that allow it.
-		if filepath.IsAbs(dir.Name) {
-			newname = path.Join(fid.path, dir.Name)
+	if gid != noId {
+		unlock := u.dirs.lock(filepath.Dir(fid.path))
+		e := u.chgrp(fid.path, st, gid, req.Conn.Srv.Upool)
+		unlock()
+		if e != nil {
+			req.RespondError(toError(e))
+			return
 		}
+	}
 
-		err := syscall.Rename(fid.path, newname)
+	if newname != "" && newname != fid.path {
+		unlock := u.dirs.lock(filepath.Dir(fid.path), filepath.Dir(newname))
+		err := u.rename(fid.path, newname)
+		unlock()
 		if err != nil {
-			req.RespondError(toError(err))
+			req.RespondError(err)
 			return
 		}
 		fid.path = newname
 	}
 
 	if dir.Length != 0xFFFFFFFFFFFFFFFF {
+		// Reserve what it grows by, and give it back if the
+		// truncate fails; count what it shrinks by after.
+		unlock := u.lockFile(st)
+		d := usage{0, 0}
+		if now, err := os.Stat(fid.path); err == nil && now.Mode().IsRegular() {
+			d.bytes = int64(dir.Length) - now.Size()
+		}
+		if d.bytes > 0 {
+			if err := u.quotaReserve(fid.path, st, d); err != nil {
+				unlock()
+				req.RespondError(toError(err))
+				return
+			}
+		}
 		e := os.Truncate(fid.path, int64(dir.Length))
+		if e != nil && d.bytes > 0 {
+			u.quotaAdd(fid.path, st, usage{-d.bytes, 0})
+		}
+		if e == nil && d.bytes < 0 {
+			u.quotaAdd(fid.path, st, d)
+		}
+		unlock()
 		if e != nil {
 			req.RespondError(toError(e))
 			return
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/mbucc/vufs"
+	"os"
+)
+
+// Check adm/users without starting a server.  Each problem is
+// printed on its own line; the exit status is 1 if there are any.
+func checkusers(args []string) int {
+	flags := flag.NewFlagSet("checkusers", flag.ExitOnError)
+	root := flags.String("root", "/", "root filesystem")
+	flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "usage: vufs checkusers [-root dir]")
+		return 2
+	}
+
+	err := vufs.CheckUsers(*root)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	return 0
+}
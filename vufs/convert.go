@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/mbucc/vufs"
+	"os"
+)
+
+// Copy file owners from one metadata store to another, for example
+// from .uidgid files to extended attributes before restarting the
+// server with -meta xattr.
+func convert(args []string) int {
+	flags := flag.NewFlagSet("convert", flag.ExitOnError)
+	root := flags.String("root", "/", "root filesystem")
+	from := flags.String("from", "uidgid", "store to copy from: uidgid, kv or xattr")
+	to := flags.String("to", "xattr", "store to copy to: uidgid, kv or xattr")
+	flags.Parse(args)
+
+	if flags.NArg() != 0 || *from == *to {
+		fmt.Fprintln(os.Stderr, "usage: vufs convert [-root dir] [-from store] [-to store]")
+		return 2
+	}
+
+	src, err := openMeta(*from, *root, true)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	dst, err := openMeta(*to, *root, false)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	n, err := vufs.CopyMeta(*root, src, dst)
+	fmt.Printf("copied the owners of %d files\n", n)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/mbucc/vufs"
+	"os"
+)
+
+// Lock a user out in adm/users.  A running server ends the user's
+// sessions when it reloads on SIGHUP.
+func disable(args []string) int {
+	return setDisabled("disable", true, args)
+}
+
+// Let a disabled user attach again.
+func enable(args []string) int {
+	return setDisabled("enable", false, args)
+}
+
+func setDisabled(cmd string, disabled bool, args []string) int {
+	flags := flag.NewFlagSet(cmd, flag.ExitOnError)
+	root := flags.String("root", "/", "root filesystem")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "usage: vufs %s [-root dir] name\n", cmd)
+		return 2
+	}
+
+	users, err := vufs.NewVusers(*root)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	err = users.SetDisabled(flags.Arg(0), disabled)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/mbucc/vufs"
+	"os"
+	"sort"
+)
+
+// Print the bytes and files owned by each user and group under root,
+// and, with -dirs, in each directory, one per line:
+//
+//	[dir] user|group name bytes files
+//
+// or, with -json, as a vufs.DiskUsage.
+func du(args []string) int {
+	flags := flag.NewFlagSet("du", flag.ExitOnError)
+	treeFlags(flags)
+	dirs := flags.Bool("dirs", false, "also show the usage of each directory")
+	asJSON := flags.Bool("json", false, "print JSON")
+	flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "usage: vufs du [-root dir] [-meta store] [-users db] [-untracked policy] [-dirs] [-json]")
+		return 2
+	}
+
+	// The server may be running, so change nothing.
+	fs, _, err := openTree(true)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	usage, err := fs.DiskUsage(*dirs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if *asJSON {
+		out, err := json.MarshalIndent(usage, "", "\t")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Println(string(out))
+		return 0
+	}
+
+	printUsage("", usage.Total)
+	names := make([]string, 0, len(usage.Dirs))
+	for dir := range usage.Dirs {
+		names = append(names, dir)
+	}
+	sort.Strings(names)
+	for _, dir := range names {
+		printUsage(dir+" ", usage.Dirs[dir])
+	}
+
+	return 0
+}
+
+func printUsage(prefix string, o *vufs.UsageByOwner) {
+	for _, kind := range []struct {
+		name  string
+		usage map[string]*vufs.Usage
+	}{{"user", o.Users}, {"group", o.Groups}} {
+		names := make([]string, 0, len(kind.usage))
+		for name := range kind.usage {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			u := kind.usage[name]
+			fmt.Printf("%s%s %s %d %d\n", prefix, kind.name, name, u.Bytes, u.Files)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/mbucc/vufs"
+	"os"
+)
+
+// Check the file owners under root, and optionally repair them.
+// Each problem is printed on its own line; the exit status is 1 if
+// there are any, whether or not they were repaired, so this can run
+// from cron.
+func fsck(args []string) int {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	userFlags(flags)
+	flags.StringVar(meta, "meta", "uidgid", "where file owners are kept: uidgid, kv or xattr")
+	repair := flags.Bool("repair", false, "fix the problems found (stop the server first)")
+	owner := flags.String("owner", "adm", "owner to give files with no owner or an unknown one")
+	ownergroup := flags.String("ownergroup", "", "group to give files with no group or an unknown one (default the -owner)")
+	flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "usage: vufs fsck [-root dir] [-meta store] [-users db] [-repair] [-owner name] [-ownergroup name]")
+		return 2
+	}
+	if *ownergroup == "" {
+		*ownergroup = *owner
+	}
+
+	users, err := openUsers(true)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	u, g := users.Uname2User(*owner), users.Gname2Group(*ownergroup)
+	if u == nil || g == nil {
+		fmt.Fprintf(os.Stderr, "no user '%s' or group '%s'\n", *owner, *ownergroup)
+		return 1
+	}
+	fix := vufs.Meta{Uid: u.Id(), Gid: g.Id(), Muid: u.Id()}
+
+	var problems []vufs.FsckProblem
+	if *meta == "uidgid" {
+		problems, err = vufs.Fsck(*root, users, *repair, fix)
+	} else {
+		var store vufs.MetaStore
+		if store, err = openMeta(*meta, *root, !*repair); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		problems, err = vufs.FsckStore(*root, users, store, *repair, fix)
+	}
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if len(problems) > 0 {
+		return 1
+	}
+
+	return 0
+}
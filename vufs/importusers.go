@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/mbucc/vufs"
+	"os"
+)
+
+// Merge host users and groups into adm/users.  Anything that can't
+// be imported is printed, and makes the exit status 1.
+func importusers(args []string) int {
+	flags := flag.NewFlagSet("importusers", flag.ExitOnError)
+	root := flags.String("root", "/", "root filesystem")
+	passwd := flags.String("passwd", "/etc/passwd", "passwd file")
+	group := flags.String("group", "/etc/group", "group file")
+	dryrun := flags.Bool("n", false, "print the merged users file instead of writing it")
+	flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "usage: vufs importusers [-root dir] [-passwd file] [-group file] [-n]")
+		return 2
+	}
+
+	merged, conflicts, err := vufs.ImportUsers(*root, *passwd, *group, *dryrun)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if *dryrun {
+		os.Stdout.Write(merged)
+	}
+
+	for _, c := range conflicts {
+		fmt.Fprintf(os.Stderr, "%s:%d: %s\n", c.File, c.Line, c.Msg)
+	}
+	if len(conflicts) > 0 {
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/mbucc/vufs"
+	"os"
+)
+
+// Rename a user in adm/users.  Ownership is stored by id, so no
+// .uidgid file changes.  A running server picks up the new name
+// on SIGHUP.
+func rename(args []string) int {
+	flags := flag.NewFlagSet("rename", flag.ExitOnError)
+	root := flags.String("root", "/", "root filesystem")
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		fmt.Fprintln(os.Stderr, "usage: vufs rename [-root dir] oldname newname")
+		return 2
+	}
+
+	users, err := vufs.NewVusers(*root)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	err = users.Rename(flags.Arg(0), flags.Arg(1))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	return 0
+}
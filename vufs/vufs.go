@@ -7,27 +7,173 @@ package main
 import (
 	"flag"
 	"fmt"
+	"github.com/lionkov/go9p/p"
 	"github.com/mbucc/vufs"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 var addr = flag.String("addr", ":5640", "network address")
 var debug = flag.Int("debug", 0, "print debug messages")
-var root = flag.String("root", "/", "root filesystem")
+var noneroot = flag.String("noneroot", "", "confine user none to this read-only directory under root")
+var quotas = flag.Bool("quotas", false, "track the space used by each user and group, and enforce the limits in root/adm/quotas")
+
+// Set by treeFlags.
+var root, untracked, defaultowner, defaultgroup, rootowner, rootgroup, meta = new(string),
+	new(string), new(string), new(string), new(string), new(string), new(string)
+var users, usersfile, passwd, group, ldapaddr, ldapbase, ldapbind = new(string),
+	new(string), new(string), new(string), new(string), new(string), new(string)
+
+// Add the flags that say where the tree, its users and its file owners
+// are to f.  The server and the commands that read the tree while it
+// runs share them.
+func treeFlags(f *flag.FlagSet) {
+	userFlags(f)
+	f.StringVar(untracked, "untracked", "default", "owner of files with no recorded owner: default (-defaultowner), inherit (the directory's) or deny (no access)")
+	f.StringVar(defaultowner, "defaultowner", "adm", "owner of untracked files for -untracked default")
+	f.StringVar(defaultgroup, "defaultgroup", "adm", "group of untracked files for -untracked default")
+	f.StringVar(rootowner, "rootowner", "adm", "owner of the root directory")
+	f.StringVar(rootgroup, "rootgroup", "adm", "group of the root directory")
+	f.StringVar(meta, "meta", "uidgid", "where file owners are kept: uidgid (a .uidgid file per directory), kv (root/adm/meta) or xattr")
+}
+
+// Add the flags that say where the tree and its users are to f.
+func userFlags(f *flag.FlagSet) {
+	f.StringVar(root, "root", "/", "root filesystem")
+	f.StringVar(users, "users", "file", "user database: file (root/adm/users), json, unix or ldap")
+	f.StringVar(usersfile, "usersfile", "", "users file for -users json")
+	f.StringVar(passwd, "passwd", "/etc/passwd", "passwd file for -users unix")
+	f.StringVar(group, "group", "/etc/group", "group file for -users unix")
+	f.StringVar(ldapaddr, "ldap", "", "LDAP server host:port for -users ldap")
+	f.StringVar(ldapbase, "ldapbase", "", "LDAP search base for -users ldap")
+	f.StringVar(ldapbind, "ldapbind", "", "LDAP bind DN, password in $VUFS_LDAP_PASSWORD (default anonymous)")
+}
+
+// Commands that run offline against an exported tree, as in
+// "vufs rename -root DIR old new".  Each gets the arguments that
+// follow its name and returns the process exit status.
+var commands = map[string]func(args []string) int{
+	"checkusers":  checkusers,
+	"convert":     convert,
+	"du":          du,
+	"disable":     disable,
+	"fsck":        fsck,
+	"enable":      enable,
+	"importusers": importusers,
+	"rename":      rename,
+}
+
+type userPool interface {
+	p.Users
+	Reload() error
+}
+
+// Load users from the database chosen with -users.  If readOnly, a
+// missing adm/users is an error rather than created.
+func openUsers(readOnly bool) (userPool, error) {
+	switch *users {
+	case "file":
+		if readOnly {
+			return vufs.OpenVusers(*root)
+		}
+		return vufs.NewVusers(*root)
+	case "json":
+		return vufs.NewJSONUsers(*usersfile)
+	case "unix":
+		return vufs.NewUnixUsers(*passwd, *group)
+	case "ldap":
+		return vufs.NewLDAPUsers(*ldapaddr, *ldapbase, *ldapbind, os.Getenv("VUFS_LDAP_PASSWORD"))
+	}
+	return nil, fmt.Errorf("unknown user database '%s'", *users)
+}
+
+// Open the metadata store called name.  If readOnly, opening it
+// writes nothing (in particular, the kv store is neither created nor
+// compacted), so it is safe beside a running server.
+func openMeta(name, root string, readOnly bool) (vufs.MetaStore, error) {
+	switch name {
+	case "uidgid":
+		return vufs.NewUidGidStore(), nil
+	case "kv":
+		if readOnly {
+			return vufs.NewReadOnlyKVStore(root)
+		}
+		return vufs.NewKVStore(root)
+	case "xattr":
+		return vufs.NewXattrStore()
+	}
+	return nil, fmt.Errorf("unknown metadata store '%s'", name)
+}
+
+// Open the tree that treeFlags name, with its users, owners and owner
+// policy.  If readOnly, nothing is created or changed on disk.
+func openTree(readOnly bool) (*vufs.VuFs, userPool, error) {
+
+	upool, err := openUsers(readOnly)
+	if err != nil {
+		return nil, nil, err
+	}
+	fs := vufs.New(*root)
+	fs.Upool = upool
+
+	fs.Untracked, err = vufs.ParseOwnerPolicy(*untracked)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, name := range []string{*defaultowner, *defaultgroup, *rootowner, *rootgroup} {
+		if upool.Uname2User(name) == nil {
+			return nil, nil, fmt.Errorf("no user or group '%s'", name)
+		}
+	}
+	fs.DefaultOwner, fs.DefaultGroup = *defaultowner, *defaultgroup
+	fs.RootOwner, fs.RootGroup = *rootowner, *rootgroup
+
+	fs.Meta, err = openMeta(*meta, *root, readOnly)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return fs, upool, nil
+}
 
 func main() {
-	var err error
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			os.Exit(cmd(os.Args[2:]))
+		}
+	}
+
+	treeFlags(flag.CommandLine)
 	flag.Parse()
-	fs := new(vufs.VuFs)
-	fs.Id = "vufs"
-	fs.Root = *root
-	fs.Debuglevel = *debug
-	fs.Upool, err  = vufs.NewVusers(*root)
+	fs, upool, err := openTree(false)
 	if err != nil {
 		log.Println(err)
 		os.Exit(1)
 	}
+	fs.Id = "vufs"
+	fs.NoneRoot = *noneroot
+	fs.Debuglevel = *debug
+
+	if *quotas {
+		if err = fs.EnableQuotas(); err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	// Pick up edits to the users (for example, from "vufs rename").
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := upool.Reload(); err != nil {
+				log.Println(err)
+			}
+			fs.EndDisabledSessions()
+		}
+	}()
 
 	fs.Start(fs)
 
@@ -9,6 +9,9 @@ import (
 	"io/ioutil"
 	"net"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -97,10 +100,10 @@ func BenchmarkReadDir(b *testing.B) {
 }
 
 var initialFiles = map[string]initialFile{
-	"/":     {"/", ".uidgid, adm, larry-moe.txt, moe-moe.txt", 0775},
+	"/":     {"/", "adm, larry-moe.txt, moe-moe.txt", 0775},
 	"/adm/": {"/adm/", "", 0775},
 	"/adm/users": {"/adm/users",
-		"1:adm:adm\n2:larry:larry\n3:moe:moe\n4:curly:curly\n",
+		"1:adm:adm\n2:larry:larry\n3:moe:moe\n4:curly:curly\n5:none:moe\n",
 		0600},
 	"/moe-moe.txt":   {"/moe-moe.txt", "whatever", 0664},
 	"/larry-moe.txt": {"/larry-moe.txt", "whatever", 0664},
@@ -173,6 +176,7 @@ func initfs(rootdir string) {
 
 
 var testserver net.Listener
+var testfs *VuFs
 var started bool
 
 func runserver(rootdir, port string) *client.Conn {
@@ -189,6 +193,7 @@ func runserver(rootdir, port string) *client.Conn {
 	//fs.Debuglevel = 1
 
 	fs.Start(fs)
+	testfs = fs
 
 	if started {
 		fmt.Println("stopping testserver")
@@ -327,7 +332,7 @@ func create(conn *client.Conn, username, filepath string, mode os.FileMode) erro
 }
 
 // Delete file or directory
-func delete(conn *client.Conn, username, filepath string) error {
+func remove(conn *client.Conn, username, filepath string) error {
 
 	fsys, err := conn.Attach(nil, username, "/")
 
@@ -396,6 +401,70 @@ func TestCreate(t *testing.T) {
 
 }
 
+func TestCreateExisting(t *testing.T) {
+
+	conn := runserver(rootdir, port)
+
+	// moe can write / through group moe, but not larry's file.
+	os.Chmod(rootdir, 0777)
+	os.Chmod(rootdir+"/larry-moe.txt", 0644)
+	if err := create(conn, "moe", "/larry-moe.txt", 0666); err == nil {
+		t.Error("moe created over larry's /larry-moe.txt")
+	}
+	if user, _, _ := usergroup(conn, "/larry-moe.txt", "moe"); user != "larry" {
+		t.Errorf("/larry-moe.txt belongs to '%s', not larry\n", user)
+	}
+	if data, _ := ioutil.ReadFile(rootdir + "/larry-moe.txt"); string(data) != "whatever" {
+		t.Errorf("/larry-moe.txt is '%s' after the create\n", data)
+	}
+}
+
+func TestCreateBadName(t *testing.T) {
+
+	conn := runserver(rootdir, port)
+
+	// larry can write /, and moe owns /moe-moe.txt.
+	os.Chmod(rootdir, 0777)
+	for _, name := range []string{"/moe-moe.txt:2:2", "/x\nmoe-moe.txt:2:2"} {
+		if err := create(conn, "larry", name, 0644); err == nil {
+			t.Errorf("larry created %q\n", name)
+		}
+	}
+	if err := create(conn, "larry", "/l.txt", 0644); err != nil {
+		t.Fatalf("larry can't create /l.txt: %v\n", err)
+	}
+	if err := rename(conn, "larry", "/l.txt", "moe-moe.txt:2:2"); err == nil {
+		t.Error("larry renamed /l.txt to 'moe-moe.txt:2:2'")
+	}
+	if user, group, _ := usergroup(conn, "/moe-moe.txt", "moe"); user != "moe" || group != "moe" {
+		t.Errorf("/moe-moe.txt belongs to %s:%s, not moe:moe\n", user, group)
+	}
+}
+
+func TestCreateInGoneGroup(t *testing.T) {
+
+	conn := runserver(rootdir, port)
+
+	// larry's /proj is in group 9, since deleted from adm/users.
+	proj := rootdir + "/proj"
+	if err := os.Mkdir(proj, 0775); err != nil {
+		t.Fatal(err)
+	}
+	if err := testfs.meta().Set(proj, nil, Meta{Uid: 2, Gid: 9, Muid: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, group, err := usergroup(conn, "/proj", "larry"); err != nil || group != "9" {
+		t.Errorf("group of /proj: '%s', %v; expected 9\n", group, err)
+	}
+	if err := create(conn, "larry", "/proj/f.txt", 0644); err != nil {
+		t.Fatalf("larry can't create /proj/f.txt: %v\n", err)
+	}
+	if _, group, _ := usergroup(conn, "/proj/f.txt", "larry"); group != "larry" {
+		t.Errorf("/proj/f.txt is in group '%s', expected larry's own\n", group)
+	}
+}
+
 func TestFiles(t *testing.T) {
 
 	conn := runserver(rootdir, port)
@@ -406,80 +475,86 @@ func TestFiles(t *testing.T) {
 			initfs(rootdir)
 		}
 
-		switch tt.op {
+		runOptest(t, conn, tt)
+	}
+}
+
+// Run one optest against the current state of the file system.
+func runOptest(t *testing.T, conn *client.Conn, tt optest) {
 
-		default:
-			t.Errorf("Unsupported operation %s in optest = %s\n", tt.op, tt)
+	switch tt.op {
 
-		case "delete":
-			err := delete(conn, tt.user, tt.path)
-			if tt.allowed {
-				if err != nil {
-					t.Errorf("%s: %v\n", tt, err)
-				}
-				fp, err := os.Open(rootdir + "/" + tt.path)
-				if err == nil {
-					fp.Close()
-					t.Errorf("%s: delete failed\n", tt)
-				} else if !os.IsNotExist(err) {
-					t.Errorf("%s: after delete, err != IsNotExist: %v\n", tt, err)
-				}
+	default:
+		t.Errorf("Unsupported operation %s in optest = %s\n", tt.op, tt)
 
-			} else {
-				if err == nil {
-					t.Errorf("%s: was allowed\n", tt)
-				}
+	case "delete":
+		err := remove(conn, tt.user, tt.path)
+		if tt.allowed {
+			if err != nil {
+				t.Errorf("%s: %v\n", tt, err)
 			}
+			fp, err := os.Open(rootdir + "/" + tt.path)
+			if err == nil {
+				fp.Close()
+				t.Errorf("%s: delete failed\n", tt)
+			} else if !os.IsNotExist(err) {
+				t.Errorf("%s: after delete, err != IsNotExist: %v\n", tt, err)
+			}
+
+		} else {
+			if err == nil {
+				t.Errorf("%s: was allowed\n", tt)
+			}
+		}
+
+		// User should be user, group should come from directory.
 
-			// User should be user, group should come from directory.
+	case "write":
+		err := os.Chmod(rootdir+tt.path, tt.mode)
+		if err != nil {
+			t.Errorf("%+v: chmod failed: %v\n", tt, err)
+		}
 
-		case "write":
-			err := os.Chmod(rootdir+tt.path, tt.mode)
+		n, newcontents, err := write(conn, tt.user, tt.path, "whom")
+		if tt.allowed {
 			if err != nil {
-				t.Errorf("%+v: chmod failed: %v\n", tt, err)
+				t.Errorf("%s: %v\n", tt, err)
 			}
 
-			n, newcontents, err := write(conn, tt.user, tt.path, "whom")
-			if tt.allowed {
-				if err != nil {
-					t.Errorf("%s: %v\n", tt, err)
-				}
-
-				if n != 4 {
-					t.Errorf("%s: exp = 4, act = %d\n", tt, n)
-				}
+			if n != 4 {
+				t.Errorf("%s: exp = 4, act = %d\n", tt, n)
+			}
 
-				if newcontents != "whomever" {
-					t.Errorf("%s: exp = 'whomever', act = '%s'\n", tt, newcontents)
-				}
+			if newcontents != "whomever" {
+				t.Errorf("%s: exp = 'whomever', act = '%s'\n", tt, newcontents)
+			}
 
-			} else {
-				if err == nil {
-					t.Errorf("%s: was allowed\n", tt)
-				}
+		} else {
+			if err == nil {
+				t.Errorf("%s: was allowed\n", tt)
 			}
+		}
 
-		case "read":
-			err := os.Chmod(rootdir+tt.path, tt.mode)
+	case "read":
+		err := os.Chmod(rootdir+tt.path, tt.mode)
+		if err != nil {
+			t.Errorf("%+v: chmod failed: %v\n", tt, err)
+		}
+		contents, err := read(conn, tt.user, tt.path)
+		if tt.allowed {
 			if err != nil {
-				t.Errorf("%+v: chmod failed: %v\n", tt, err)
+				t.Errorf("%s: %v\n", tt, err)
 			}
-			contents, err := read(conn, tt.user, tt.path)
-			if tt.allowed {
-				if err != nil {
-					t.Errorf("%s: %v\n", tt, err)
-				}
-				f, found := initialFiles[tt.path]
-				if !found {
-					t.Errorf("%s: not found in initialFiles\n", tt)
-				}
-				if contents != f.contents {
-					t.Errorf("%s: exp = '%s', act = '%s'\n", tt, f.contents, contents)
-				}
-			} else {
-				if err == nil {
-					t.Errorf("%s: was allowed\n", tt)
-				}
+			f, found := initialFiles[tt.path]
+			if !found {
+				t.Errorf("%s: not found in initialFiles\n", tt)
+			}
+			if contents != f.contents {
+				t.Errorf("%s: exp = '%s', act = '%s'\n", tt, f.contents, contents)
+			}
+		} else {
+			if err == nil {
+				t.Errorf("%s: was allowed\n", tt)
 			}
 		}
 	}
@@ -557,6 +632,12 @@ var optests []optest = []optest{
 	{true, "larry", "write", 0660, "/larry-moe.txt", false},
 	{false, "curly", "write", 0660, "/larry-moe.txt", false},
 
+	// User none is in group moe, but only gets other permissions.
+	{false, "none", "read", 0440, "/moe-moe.txt", false},
+	{true, "none", "read", 0444, "/moe-moe.txt", false},
+	{false, "none", "write", 0660, "/moe-moe.txt", false},
+	{true, "none", "write", 0666, "/moe-moe.txt", false},
+
 	/*
 
 
@@ -575,3 +656,792 @@ var optests []optest = []optest{
 		{true, "larry", "", "delete", 0600, "/books/larry/draft", true},
 	*/
 }
+
+// Write a command to adm/ctl as adm.
+func ctl(conn *client.Conn, command string) error {
+	fsys, err := conn.Attach(nil, "adm", "/")
+	if err != nil {
+		return err
+	}
+	fid, err := fsys.Open("/adm/ctl", plan9.OWRITE)
+	if err != nil {
+		return err
+	}
+	defer fid.Close()
+	_, err = fid.Write([]byte(command))
+	return err
+}
+
+// optests run with an ACL, set (by adm, through adm/ctl) first.
+var aclOptests = []struct {
+	acl string
+	optest
+}{
+	{"/moe-moe.txt u:curly+r", optest{true, "curly", "read", 0600, "/moe-moe.txt", true}},
+	{"/moe-moe.txt u:curly+r", optest{false, "curly", "write", 0600, "/moe-moe.txt", true}},
+	{"/moe-moe.txt u:curly+rw", optest{true, "curly", "write", 0600, "/moe-moe.txt", true}},
+	{"/moe-moe.txt u:curly-r", optest{false, "curly", "read", 0644, "/moe-moe.txt", true}},
+	{"/moe-moe.txt u:curly-r", optest{true, "larry", "read", 0644, "/moe-moe.txt", true}},
+
+	// Deny entries apply to the owner too.
+	{"/moe-moe.txt u:moe-r", optest{false, "moe", "read", 0600, "/moe-moe.txt", true}},
+
+	// Group entries.
+	{"/larry-moe.txt g:moe-w", optest{false, "moe", "write", 0660, "/larry-moe.txt", true}},
+	{"/larry-moe.txt g:moe-w", optest{true, "larry", "write", 0660, "/larry-moe.txt", true}},
+	{"/larry-moe.txt g:curly+w", optest{true, "curly", "write", 0600, "/larry-moe.txt", true}},
+
+	// none is in group moe, but only user entries for none count.
+	{"/moe-moe.txt g:moe+r", optest{false, "none", "read", 0600, "/moe-moe.txt", true}},
+	{"/moe-moe.txt u:none+r", optest{true, "none", "read", 0600, "/moe-moe.txt", true}},
+}
+
+func TestACLFiles(t *testing.T) {
+
+	conn := runserver(rootdir, port)
+
+	for _, tt := range aclOptests {
+		initfs(rootdir)
+		if err := ctl(conn, "acl "+tt.acl); err != nil {
+			t.Errorf("acl %s: %v\n", tt.acl, err)
+			continue
+		}
+		runOptest(t, conn, tt.optest)
+	}
+}
+
+func TestNoneRoot(t *testing.T) {
+
+	users, err := NewVusers("./test")
+	if err != nil {
+		t.Fatalf("NewVusers(./test): %v\n", err)
+	}
+	none, glenda := users.Uname2User("none"), users.Uname2User("glenda")
+
+	fs := New("/srv")
+	if fs.rootFor(none) != "/srv" || fs.readOnly(none) {
+		t.Error("none restricted without NoneRoot set")
+	}
+
+	fs.NoneRoot = "../pub"
+	if r := fs.rootFor(none); r != "/srv/pub" {
+		t.Errorf("rootFor(none) = '%s', expected '/srv/pub'\n", r)
+	}
+	if !fs.readOnly(none) {
+		t.Error("none can write under NoneRoot")
+	}
+	if fs.rootFor(glenda) != "/srv" || fs.readOnly(glenda) {
+		t.Error("NoneRoot applies to glenda")
+	}
+}
+
+func TestDisableUser(t *testing.T) {
+
+	conn := runserver(rootdir, port)
+
+	fsys, err := conn.Attach(nil, "moe", "/")
+	if err != nil {
+		t.Fatalf("moe can't attach: %v\n", err)
+	}
+
+	err = testfs.DisableUser("moe")
+	if err != nil {
+		t.Fatalf("DisableUser(moe): %v\n", err)
+	}
+
+	// moe's connection was closed.
+	if _, err = fsys.Stat("/moe-moe.txt"); err == nil {
+		t.Error("moe's session still works after disable")
+	}
+
+	conn, err = client.Dial("tcp", port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err = conn.Attach(nil, "moe", "/"); err == nil {
+		t.Error("disabled moe could attach")
+	}
+
+	// moe still owns moe-moe.txt.
+	user, _, err := usergroup(conn, "/moe-moe.txt", "larry")
+	if err != nil {
+		t.Fatalf("larry can't stat /moe-moe.txt: %v\n", err)
+	}
+	if user != "moe" {
+		t.Errorf("owner of /moe-moe.txt is '%s', not moe\n", user)
+	}
+}
+
+func TestSessionsFile(t *testing.T) {
+
+	conn := runserver(rootdir, port)
+
+	moe, err := conn.Attach(nil, "moe", "/")
+	if err != nil {
+		t.Fatalf("moe can't attach: %v\n", err)
+	}
+
+	if _, err = read(conn, "moe", "/adm/sessions"); err == nil {
+		t.Error("moe can read /adm/sessions")
+	}
+
+	sessions, err := read(conn, "adm", "/adm/sessions")
+	if err != nil {
+		t.Fatalf("adm can't read /adm/sessions: %v\n", err)
+	}
+	if !strings.Contains(sessions, "moe") {
+		t.Errorf("moe not listed in /adm/sessions:\n%s\n", sessions)
+	}
+
+	other, err := client.Dial("tcp", port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	admin, err := other.Attach(nil, "adm", "/")
+	if err != nil {
+		t.Fatalf("adm can't attach: %v\n", err)
+	}
+	ctl, err := admin.Open("/adm/ctl", plan9.OWRITE)
+	if err != nil {
+		t.Fatalf("adm can't open /adm/ctl: %v\n", err)
+	}
+	defer ctl.Close()
+
+	if _, err = ctl.Write([]byte("killuser moe")); err != nil {
+		t.Fatalf("killuser moe: %v\n", err)
+	}
+
+	if _, err = moe.Stat("/moe-moe.txt"); err == nil {
+		t.Error("moe's session still works after killuser")
+	}
+	if _, err = admin.Stat("/moe-moe.txt"); err != nil {
+		t.Errorf("adm's session ended by killuser moe: %v\n", err)
+	}
+}
+
+// Many clients creating, renaming and removing files in one directory
+// at once must not lose or garble each other's ownership entries.  Run
+// with -race.
+func TestConcurrentMetadata(t *testing.T) {
+
+	conn := runserver(rootdir, port)
+
+	if err := create(conn, "adm", "/race", os.ModeDir+0777); err != nil {
+		t.Fatalf("adm can't create /race: %v\n", err)
+	}
+	// Whatever the umask.
+	os.Chmod(rootdir+"/race", 0777)
+
+	const (
+		clients = 8
+		files   = 25
+	)
+	users := []string{"adm", "larry", "moe", "curly"}
+
+	errs := make(chan error, clients)
+	for c := 0; c < clients; c++ {
+		go func(c int) {
+			user := users[c%len(users)]
+			conn, err := client.Dial("tcp", port)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+			fsys, err := conn.Attach(nil, user, "/")
+			if err != nil {
+				errs <- err
+				return
+			}
+			for i := 0; i < files; i++ {
+				name := fmt.Sprintf("/race/%s-%d-%d", user, c, i)
+				fid, err := fsys.Create(name, plan9.OREAD, 0664)
+				if err != nil {
+					errs <- fmt.Errorf("create %s: %v", name, err)
+					return
+				}
+				fid.Close()
+				switch i % 3 {
+				case 1:
+					var dir plan9.Dir
+					dir.Null()
+					dir.Name = filepath.Base(name) + ".mv"
+					err = fsys.Wstat(name, &dir)
+				case 2:
+					err = fsys.Remove(name)
+				}
+				if err != nil {
+					errs <- fmt.Errorf("%s: %v", name, err)
+					return
+				}
+			}
+			errs <- nil
+		}(c)
+	}
+	for c := 0; c < clients; c++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+
+	dir := rootdir + "/race"
+	entries, err := readUidGid(dir)
+	if err != nil {
+		t.Fatalf("readUidGid(%s): %v\n", dir, err)
+	}
+	for c := 0; c < clients; c++ {
+		user := users[c%len(users)]
+		uid := c%len(users) + 1
+		for i := 0; i < files; i++ {
+			name := fmt.Sprintf("%s-%d-%d", user, c, i)
+			e, found := entries[name]
+			switch i % 3 {
+			case 0:
+				if !found || e.Uid != uid {
+					t.Errorf("%s: entry %v, found = %v; expected uid %d\n", name, e, found, uid)
+				}
+			case 1:
+				if e, found := entries[name+".mv"]; !found || e.Uid != uid {
+					t.Errorf("%s.mv: entry %v, found = %v; expected uid %d\n", name, e, found, uid)
+				}
+				if found {
+					t.Errorf("%s: renamed, but still has entry %v\n", name, e)
+				}
+			case 2:
+				if found {
+					t.Errorf("%s: removed, but still has entry %v\n", name, e)
+				}
+			}
+		}
+	}
+
+	names, _ := filepath.Glob(dir + "/" + uidgidFile + "?*")
+	if len(names) != 0 {
+		t.Errorf("temporary files left behind: %v\n", names)
+	}
+}
+
+func TestMetadataHidden(t *testing.T) {
+
+	conn := runserver(rootdir, port)
+
+	if _, err := read(conn, "adm", "/"+uidgidFile); err == nil {
+		t.Errorf("adm can read /%s outside the admin view\n", uidgidFile)
+	}
+	if err := create(conn, "adm", "/"+uidgidFile, 0666); err == nil {
+		t.Errorf("adm can create /%s\n", uidgidFile)
+	}
+
+	fsys, err := conn.Attach(nil, "moe", "/")
+	if err != nil {
+		t.Fatalf("moe can't attach: %v\n", err)
+	}
+	var dir plan9.Dir
+	dir.Null()
+	dir.Name = uidgidFile
+	if err = fsys.Wstat("/moe-moe.txt", &dir); err == nil {
+		t.Errorf("moe can rename /moe-moe.txt to %s\n", uidgidFile)
+	}
+
+	if _, err = conn.Attach(nil, "moe", adminAname); err == nil {
+		t.Error("moe can attach to the admin view")
+	}
+
+	admin, err := conn.Attach(nil, "adm", adminAname)
+	if err != nil {
+		t.Fatalf("adm can't attach to the admin view: %v\n", err)
+	}
+	fid, err := admin.Open("/"+uidgidFile, plan9.OREAD)
+	if err != nil {
+		t.Fatalf("adm can't open /%s in the admin view: %v\n", uidgidFile, err)
+	}
+	data, err := ioutil.ReadAll(fid)
+	fid.Close()
+	if err != nil || string(data) != initialFiles["/"+uidgidFile].contents {
+		t.Errorf("read /%s in the admin view: '%s', %v\n", uidgidFile, data, err)
+	}
+	if _, err = admin.Open("/"+uidgidFile, plan9.OWRITE); err == nil {
+		t.Errorf("adm can write /%s in the admin view\n", uidgidFile)
+	}
+	if err = admin.Remove("/" + uidgidFile); err == nil {
+		t.Errorf("adm can remove /%s in the admin view\n", uidgidFile)
+	}
+}
+
+// Rename with Wstat, as user, the file at from to name.
+func rename(conn *client.Conn, user, from, name string) error {
+	fsys, err := conn.Attach(nil, user, "/")
+	if err != nil {
+		return err
+	}
+	var dir plan9.Dir
+	dir.Null()
+	dir.Name = name
+	return fsys.Wstat(from, &dir)
+}
+
+func TestWstatRename(t *testing.T) {
+
+	conn := runserver(rootdir, port)
+
+	for _, d := range []string{"/open", "/closed"} {
+		if err := create(conn, "adm", d, os.ModeDir+0777); err != nil {
+			t.Fatalf("adm can't create %s: %v\n", d, err)
+		}
+	}
+	os.Chmod(rootdir+"/open", 0777)
+	os.Chmod(rootdir+"/closed", 0755)
+	if err := create(conn, "larry", "/open/l.txt", 0644); err != nil {
+		t.Fatalf("larry can't create /open/l.txt: %v\n", err)
+	}
+
+	tests := []struct {
+		allowed bool
+		user    string
+		from    string
+		name    string
+		to      string
+	}{
+		// moe can't write /.
+		{false, "moe", "/moe-moe.txt", "moe.txt", ""},
+		{true, "adm", "/moe-moe.txt", "moe.txt", "/moe.txt"},
+		// Not onto another file.
+		{false, "adm", "/moe.txt", "larry-moe.txt", ""},
+		{false, "adm", "/moe.txt", "/larry-moe.txt", ""},
+		// Moves need write permission on both directories.
+		{false, "larry", "/open/l.txt", "/closed/l.txt", ""},
+		{true, "adm", "/moe.txt", "/closed/moe.txt", "/closed/moe.txt"},
+		{true, "larry", "/open/l.txt", "/open/m.txt", "/open/m.txt"},
+		// No moving out of the root, or into oneself.
+		{true, "adm", "/open/m.txt", "/../../m.txt", "/m.txt"},
+		{false, "adm", "/open", "/open/sub", ""},
+	}
+
+	owners := map[string]string{"/moe-moe.txt": "moe", "/open/l.txt": "larry"}
+	for _, tt := range tests {
+		err := rename(conn, tt.user, tt.from, tt.name)
+		if !tt.allowed {
+			if err == nil {
+				t.Errorf("%s could rename %s to %s\n", tt.user, tt.from, tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s can't rename %s to %s: %v\n", tt.user, tt.from, tt.name, err)
+			continue
+		}
+		owners[tt.to] = owners[tt.from]
+		user, _, err := usergroup(conn, tt.to, "adm")
+		if err != nil || user != owners[tt.to] {
+			t.Errorf("owner of %s after rename: '%s', %v; expected %s\n", tt.to, user, err, owners[tt.to])
+		}
+	}
+}
+
+func TestUntrackedDenied(t *testing.T) {
+
+	conn := runserver(rootdir, port)
+	testfs.Untracked = OwnDeny
+	defer func() { testfs.Untracked = OwnDefault }()
+
+	// Created on the host, so nobody owns it.
+	err := ioutil.WriteFile(rootdir+"/host.txt", []byte("host"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = read(conn, "moe", "/host.txt"); err == nil {
+		t.Error("moe can read untracked /host.txt")
+	}
+	if _, err = read(conn, "moe", "/moe-moe.txt"); err != nil {
+		t.Errorf("moe can't read /moe-moe.txt: %v\n", err)
+	}
+
+	// Nor do untracked directories, but adm/ is always adm's.
+	if err = os.Mkdir(rootdir+"/hostdir", 0777); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = read(conn, "moe", "/hostdir"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("moe's read of untracked /hostdir: %v; expected it not to exist\n", err)
+	}
+	if _, err = read(conn, "adm", "/adm/sessions"); err != nil {
+		t.Errorf("adm can't read /adm/sessions: %v\n", err)
+	}
+	if err = ctl(conn, "killuser curly"); err != nil {
+		t.Errorf("adm can't write /adm/ctl: %v\n", err)
+	}
+
+	listing, err := read(conn, "adm", "/")
+	if err != nil {
+		t.Fatalf("adm can't read /: %v\n", err)
+	}
+	if strings.Contains(listing, "host.txt") || strings.Contains(listing, "hostdir") {
+		t.Errorf("untracked host.txt or hostdir is listed in /: %s\n", listing)
+	}
+}
+
+func TestModeBits(t *testing.T) {
+
+	conn := runserver(rootdir, port)
+
+	fsys, err := conn.Attach(nil, "moe", "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fid, err := fsys.Create("/moe.log", plan9.OWRITE, plan9.DMAPPEND|plan9.DMEXCL|0644)
+	if err != nil {
+		t.Fatalf("moe can't create /moe.log: %v\n", err)
+	}
+	if qt := fid.Qid().Type; qt != plan9.QTAPPEND|plan9.QTEXCL {
+		t.Errorf("qid type of /moe.log is %#x, expected QTAPPEND|QTEXCL\n", qt)
+	}
+	// Both go at the end, whatever the offset.
+	fid.WriteAt([]byte("one\n"), 0)
+	fid.WriteAt([]byte("two\n"), 0)
+	fid.Close()
+
+	data, _ := ioutil.ReadFile(rootdir + "/moe.log")
+	if string(data) != "one\ntwo\n" {
+		t.Errorf("/moe.log is '%s', expected 'one\\ntwo\\n'\n", data)
+	}
+
+	// Nor do appends at once, or on the host, overwrite each other.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		fid, err := fsys.Open("/moe.log", plan9.OWRITE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer fid.Close()
+			fid.WriteAt([]byte("more\n"), 0)
+		}()
+	}
+	if f, err := os.OpenFile(rootdir+"/moe.log", os.O_WRONLY|os.O_APPEND, 0); err == nil {
+		f.Write([]byte("host\n"))
+		f.Close()
+	}
+	wg.Wait()
+	if st, _ := os.Stat(rootdir + "/moe.log"); st.Size() != 8+10*5+5 {
+		t.Errorf("/moe.log is %d bytes after 11 appends, expected %d\n", st.Size(), 8+10*5+5)
+	}
+
+	var dir plan9.Dir
+	dir.Null()
+	dir.Mode = plan9.DMTMP | 0600
+	if err = fsys.Wstat("/moe.log", &dir); err != nil {
+		t.Fatalf("moe can't wstat /moe.log: %v\n", err)
+	}
+	d, err := fsys.Stat("/moe.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Mode != plan9.DMTMP|0600 || d.Qid.Type != plan9.QTTMP {
+		t.Errorf("/moe.log has mode %v, qid type %#x; expected DMTMP|0600, QTTMP\n", d.Mode, d.Qid.Type)
+	}
+	if st, _ := os.Stat(rootdir + "/moe.log"); st.Mode() != 0600 {
+		t.Errorf("host mode of /moe.log is %v, expected -rw-------\n", st.Mode())
+	}
+
+	// Only the owner (or adm) may change the mode.
+	larry, err := conn.Attach(nil, "larry", "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir.Mode = 0666
+	if err = larry.Wstat("/moe.log", &dir); err == nil {
+		t.Error("larry cleared DMTMP on moe's /moe.log")
+	}
+	if testfs.metaMode(rootdir+"/moe.log", nil) != plan9.DMTMP {
+		t.Errorf("/moe.log has mode bits %#x after larry's wstat\n", testfs.metaMode(rootdir+"/moe.log", nil))
+	}
+
+	// The root can't keep the bits, so its mode doesn't change either.
+	admin, err := conn.Attach(nil, "adm", "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir.Mode = plan9.DMDIR | plan9.DMAPPEND | 0777
+	if err = admin.Wstat("/", &dir); err == nil {
+		t.Error("adm made / append-only")
+	}
+	if st, _ := os.Stat(rootdir); st.Mode().Perm() != 0775 {
+		t.Errorf("host mode of / is %v after a failed wstat\n", st.Mode())
+	}
+}
+
+func TestCreateDefaults(t *testing.T) {
+
+	conn := runserver(rootdir, port)
+
+	if err := create(conn, "adm", "/proj", os.ModeDir+0777); err != nil {
+		t.Fatalf("adm can't create /proj: %v\n", err)
+	}
+	os.Chmod(rootdir+"/proj", 0777)
+
+	err := ctl(conn, "defaults /proj group=moe mask=0770 force=0060")
+	if err != nil {
+		t.Fatalf("defaults /proj: %v\n", err)
+	}
+
+	// The new directory gets the same defaults.
+	for _, fn := range []string{"/proj/sub", "/proj/l.txt", "/proj/sub/l.txt"} {
+		mode := os.FileMode(0644)
+		if fn == "/proj/sub" {
+			mode = os.ModeDir + 0755
+		}
+		if err = create(conn, "larry", fn, mode); err != nil {
+			t.Fatalf("larry can't create %s: %v\n", fn, err)
+		}
+		user, group, err := usergroup(conn, fn, "larry")
+		if err != nil || user != "larry" || group != "moe" {
+			t.Errorf("owner of %s: %s, %s, %v; expected larry, moe\n", fn, user, group, err)
+		}
+		st, _ := os.Stat(rootdir + fn)
+		if perm := st.Mode() & 0777; perm != mode&0777&0770|0060 {
+			t.Errorf("%s has permissions %#o, expected %#o\n", fn, perm, mode&0777&0770|0060)
+		}
+	}
+}
+
+func TestRemovePerm(t *testing.T) {
+
+	conn := runserver(rootdir, port)
+
+	// / is adm's, and only group adm may write it.
+	if err := remove(conn, "moe", "/moe-moe.txt"); err == nil {
+		t.Error("moe removed /moe-moe.txt from /, which he can't write")
+	}
+	if _, err := os.Stat(rootdir + "/moe-moe.txt"); err != nil {
+		t.Errorf("/moe-moe.txt is gone: %v\n", err)
+	}
+	if err := remove(conn, "adm", "/moe-moe.txt"); err != nil {
+		t.Errorf("adm can't remove /moe-moe.txt: %v\n", err)
+	}
+}
+
+func TestStickyDir(t *testing.T) {
+
+	conn := runserver(rootdir, port)
+
+	if err := create(conn, "adm", "/tmp", os.ModeDir+0777); err != nil {
+		t.Fatalf("adm can't create /tmp: %v\n", err)
+	}
+	os.Chmod(rootdir+"/tmp", 0777)
+	if err := ctl(conn, "sticky /tmp"); err != nil {
+		t.Fatalf("sticky /tmp: %v\n", err)
+	}
+	for _, fn := range []string{"/tmp/l1.txt", "/tmp/l2.txt"} {
+		if err := create(conn, "larry", fn, 0666); err != nil {
+			t.Fatalf("larry can't create %s: %v\n", fn, err)
+		}
+	}
+
+	// Only adm, who owns /tmp, may change its mode.
+	fsys, err := conn.Attach(nil, "moe", "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dir plan9.Dir
+	dir.Null()
+	dir.Mode = plan9.DMDIR | 0777
+	if err = fsys.Wstat("/tmp", &dir); err == nil {
+		t.Error("moe changed the mode of adm's /tmp")
+	}
+	if testfs.metaMode(rootdir+"/tmp", nil)&DMSTICKY == 0 {
+		t.Error("/tmp is no longer sticky")
+	}
+
+	if err := remove(conn, "moe", "/tmp/l1.txt"); err == nil {
+		t.Error("moe removed larry's /tmp/l1.txt")
+	}
+	if err := rename(conn, "moe", "/tmp/l1.txt", "m.txt"); err == nil {
+		t.Error("moe renamed larry's /tmp/l1.txt")
+	}
+	if err := rename(conn, "larry", "/tmp/l1.txt", "l3.txt"); err != nil {
+		t.Errorf("larry can't rename /tmp/l1.txt: %v\n", err)
+	}
+	if err := remove(conn, "larry", "/tmp/l3.txt"); err != nil {
+		t.Errorf("larry can't remove /tmp/l3.txt: %v\n", err)
+	}
+	if err := remove(conn, "adm", "/tmp/l2.txt"); err != nil {
+		t.Errorf("adm can't remove /tmp/l2.txt: %v\n", err)
+	}
+}
+
+func TestDropboxDir(t *testing.T) {
+
+	conn := runserver(rootdir, port)
+
+	if err := create(conn, "adm", "/box", os.ModeDir+0777); err != nil {
+		t.Fatalf("adm can't create /box: %v\n", err)
+	}
+	os.Chmod(rootdir+"/box", 0777)
+	if err := ctl(conn, "dropbox /box"); err != nil {
+		t.Fatalf("dropbox /box: %v\n", err)
+	}
+	for _, f := range []struct{ user, path string }{{"larry", "/box/l.txt"}, {"moe", "/box/m.txt"}} {
+		if err := create(conn, f.user, f.path, 0644); err != nil {
+			t.Fatalf("%s can't create %s: %v\n", f.user, f.path, err)
+		}
+	}
+
+	listing, err := read(conn, "moe", "/box")
+	if err != nil || listing != "m.txt" {
+		t.Errorf("moe's listing of /box: '%s', %v; expected m.txt\n", listing, err)
+	}
+	if _, err = read(conn, "moe", "/box/l.txt"); err == nil {
+		t.Error("moe can read larry's /box/l.txt")
+	}
+	if _, err = read(conn, "moe", "/box/m.txt"); err != nil {
+		t.Errorf("moe can't read /box/m.txt: %v\n", err)
+	}
+
+	listing, err = read(conn, "adm", "/box")
+	if err != nil || !strings.Contains(listing, "l.txt") || !strings.Contains(listing, "m.txt") {
+		t.Errorf("adm's listing of /box: '%s', %v; expected l.txt and m.txt\n", listing, err)
+	}
+
+	// Creating over larry's hidden file doesn't open or take it.
+	fsys, err := conn.Attach(nil, "moe", "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fid, err := fsys.Create("/box/l.txt", plan9.ORDWR, 0666); err == nil {
+		fid.Close()
+		t.Error("moe created over larry's /box/l.txt")
+	}
+	if user, _, _ := usergroup(conn, "/box/l.txt", "adm"); user != "larry" {
+		t.Errorf("/box/l.txt belongs to '%s', not larry\n", user)
+	}
+}
+
+// Change, with Wstat as user, the group of the file at path.
+func chgrp(conn *client.Conn, user, path, group string) error {
+	fsys, err := conn.Attach(nil, user, "/")
+	if err != nil {
+		return err
+	}
+	var dir plan9.Dir
+	dir.Null()
+	dir.Gid = group
+	return fsys.Wstat(path, &dir)
+}
+
+// Writes at once to the end of one file count what the file grew by.
+func TestQuotaConcurrentWrites(t *testing.T) {
+
+	conn := runserver(rootdir, port)
+	if err := testfs.EnableQuotas(); err != nil {
+		t.Fatalf("EnableQuotas: %v\n", err)
+	}
+	defer func() { testfs.quotas.on = false }()
+
+	if err := create(conn, "larry", "/c.txt", 0666); err != nil {
+		t.Fatalf("larry can't create /c.txt: %v\n", err)
+	}
+	fsys, err := conn.Attach(nil, "larry", "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		fid, err := fsys.Open("/c.txt", plan9.OWRITE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer fid.Close()
+			if _, err := fid.WriteAt(make([]byte, 100), 0); err != nil {
+				t.Errorf("write to /c.txt: %v\n", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// larry already has the 8 bytes of /larry-moe.txt.
+	usage, err := read(conn, "adm", "/adm/usage")
+	if err != nil || !strings.Contains(usage, "user larry 108 2 - -\n") {
+		t.Errorf("adm/usage is '%s', %v; expected larry to use 108 bytes in 2 files\n", usage, err)
+	}
+}
+
+func TestQuotaFiles(t *testing.T) {
+
+	conn := runserver(rootdir, port)
+	err := ioutil.WriteFile(rootdir+"/"+quotasFile, []byte("user larry 14 -\ngroup larry - 0\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = testfs.EnableQuotas(); err != nil {
+		t.Fatalf("EnableQuotas: %v\n", err)
+	}
+	defer func() { testfs.quotas.on = false }()
+
+	// larry already has the 8 bytes of /larry-moe.txt.
+	if err = create(conn, "larry", "/q.txt", 0666); err != nil {
+		t.Fatalf("larry can't create /q.txt: %v\n", err)
+	}
+	if _, _, err = write(conn, "larry", "/q.txt", "whom"); err != nil {
+		t.Fatalf("larry can't write 4 bytes to /q.txt: %v\n", err)
+	}
+
+	fsys, err := conn.Attach(nil, "larry", "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fid, err := fsys.Open("/q.txt", plan9.OWRITE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fid.WriteAt([]byte("whom"), 4); err == nil {
+		t.Error("larry wrote past his 14 byte quota")
+	}
+	if _, err = fid.WriteAt([]byte("wh"), 0); err != nil {
+		t.Errorf("larry can't overwrite /q.txt: %v\n", err)
+	}
+	fid.Close()
+
+	var dir plan9.Dir
+	dir.Null()
+	dir.Length = 7
+	if err = fsys.Wstat("/q.txt", &dir); err == nil {
+		t.Error("larry made /q.txt longer than his quota")
+	}
+
+	usage, err := read(conn, "adm", "/adm/usage")
+	if err != nil || !strings.Contains(usage, "user larry 12 2 14 -\n") {
+		t.Errorf("adm/usage is '%s', %v; expected larry to use 12 bytes in 2 files\n", usage, err)
+	}
+
+	if err = chgrp(conn, "larry", "/q.txt", "larry"); err == nil {
+		t.Error("larry put /q.txt in group larry, which has no room")
+	}
+	if err = chgrp(conn, "moe", "/q.txt", "moe"); err == nil {
+		t.Error("moe changed the group of larry's /q.txt")
+	}
+	if err = chgrp(conn, "adm", "/q.txt", "curly"); err != nil {
+		t.Errorf("adm can't put /q.txt in group curly: %v\n", err)
+	}
+	if _, group, _ := usergroup(conn, "/q.txt", "larry"); group != "curly" {
+		t.Errorf("/q.txt is in group '%s', not curly\n", group)
+	}
+
+	if err = remove(conn, "larry", "/q.txt"); err != nil {
+		t.Fatalf("larry can't remove /q.txt: %v\n", err)
+	}
+	usage, _ = read(conn, "adm", "/adm/usage")
+	if !strings.Contains(usage, "user larry 8 1 14 -\n") || !strings.Contains(usage, "group larry 0 0 - 0\n") ||
+		strings.Contains(usage, "group curly") {
+		t.Errorf("adm/usage after remove is '%s'\n", usage)
+	}
+}
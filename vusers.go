@@ -11,7 +11,9 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/lionkov/go9p/p"
@@ -19,10 +21,12 @@ import (
 
 const (
 	usersFile = "adm/users"
+	// Set in the optional fourth column of adm/users to lock a user out.
+	disabledFlag = "disabled"
 )
 
 var (
-	badUsernameChar = []rune{'?', '=', '+', '–', '/', ':'}
+	badUsernameChar = []rune{'?', '=', '+', '–', '/', ':', ','}
 	initialUsers    = []byte("1:adm:\n2:mark:\n")
 )
 
@@ -34,17 +38,24 @@ type vUser struct {
 	id int
 	// The string used to represent this user in the 9P protocol.
 	// This can change, for example if a user changes their name.
-	// (Renaming is not currently supported.)
 	name string
 	// A comma-separated list of members in this group
 	members []p.User
 	// A comma-separated list of groups this user is part of.
 	groups []p.Group
+	// Every group this user is part of, directly or through
+	// groups that are themselves in groups.
+	allGroups []p.Group
+	// A disabled user can't attach, but still owns its files.
+	disabled bool
+	// Guards name, members, groups and disabled, which change on
+	// rename and reload.
+	sync.Mutex
 }
 
 // Simple p.Users implementation of virtual users.
 type vUsers struct {
-	root       string
+	source     userSource
 	nameToUser map[string]*vUser
 	idToUser   map[int]*vUser
 	sync.Mutex
@@ -57,13 +68,40 @@ go9p interfaces:
 	Users	../../rminnich/go9p/p9.go:184,190
 */
 
-func (u *vUser) Name() string { return u.name }
+func (u *vUser) Name() string {
+	u.Lock()
+	defer u.Unlock()
+	return u.name
+}
 
 func (u *vUser) Id() int { return u.id }
 
-func (u *vUser) Groups() []p.Group { return u.groups }
+func (u *vUser) Groups() []p.Group {
+	u.Lock()
+	defer u.Unlock()
+	return u.groups
+}
+
+// AllGroups returns the groups this user is in, including the
+// groups those groups are in, and so on.
+func (u *vUser) AllGroups() []p.Group {
+	u.Lock()
+	defer u.Unlock()
+	return u.allGroups
+}
+
+// Disabled reports whether the user has been locked out.
+func (u *vUser) Disabled() bool {
+	u.Lock()
+	defer u.Unlock()
+	return u.disabled
+}
 
-func (u *vUser) Members() []p.User { return u.members }
+func (u *vUser) Members() []p.User {
+	u.Lock()
+	defer u.Unlock()
+	return u.members
+}
 
 func (u *vUser) IsMember(g p.Group) bool {
 	// The Id is the immutable fact for the user.
@@ -72,7 +110,7 @@ func (u *vUser) IsMember(g p.Group) bool {
 	// (as opposed to string in Plan9), but this has the
 	// advantage of using compiler to ensure that we can't
 	// check an Id() against a Name().
-	for _, b := range u.groups {
+	for _, b := range u.AllGroups() {
 		if b.Id() == g.Id() {
 			return true
 		}
@@ -102,11 +140,19 @@ func (up *vUsers) Uname2User(uname string) p.User {
 }
 
 func (up *vUsers) Gid2Group(gid int) p.Group {
-	return up.Uid2User(gid).(p.Group)
+	user := up.Uid2User(gid)
+	if user == nil {
+		return nil
+	}
+	return user.(p.Group)
 }
 
 func (up *vUsers) Gname2Group(gname string) p.Group {
-	return up.Uname2User(gname).(p.Group)
+	user := up.Uname2User(gname)
+	if user == nil {
+		return nil
+	}
+	return user.(p.Group)
 }
 
 // Open userfile.  Create if not found.
@@ -142,16 +188,132 @@ func readUserFile(userfile string) ([]byte, error) {
 
 }
 
+// A source of users, such as adm/users or the host's /etc/passwd.
+// Every source feeds the same checks and the same vUsers.
+type userSource interface {
+	// Where the users come from, for error messages.
+	String() string
+	// Read every user.  Problems with single entries are added to
+	// problems; err is for when the source can't be read at all.
+	load(problems *UsersError) ([]userEntry, error)
+}
+
+// Users read from adm/users under the root of the file system.
+type fileSource struct {
+	root string
+}
+
+func (s *fileSource) String() string { return filepath.Join(s.root, usersFile) }
+
+func (s *fileSource) load(problems *UsersError) ([]userEntry, error) {
+	data, err := ioutil.ReadFile(s.String())
+	if err != nil {
+		return nil, err
+	}
+	return readUserEntries(data, problems), nil
+}
+
 func NewVusers(root string) (*vUsers, error) {
 
 	userfn := filepath.Join(root, usersFile)
 
-	data, err := readUserFile(userfn)
+	_, err := readUserFile(userfn)
 	if err != nil {
 		return nil, err
 	}
 
-	nameToUser := make(map[string]*vUser)
+	return newUsers(&fileSource{root})
+}
+
+// OpenVusers reads adm/users under root, which, unlike for
+// NewVusers, must already exist.
+func OpenVusers(root string) (*vUsers, error) {
+	return newUsers(&fileSource{root})
+}
+
+func newUsers(source userSource) (*vUsers, error) {
+
+	problems := &UsersError{File: source.String()}
+
+	entries, err := source.load(problems)
+	if err != nil {
+		return nil, err
+	}
+
+	nameToUser, err := buildUsers(entries, problems)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create second map, of ID to user.
+	idToUser := make(map[int]*vUser, len(nameToUser))
+	for _, user := range nameToUser {
+		idToUser[user.Id()] = user
+	}
+
+	return &vUsers{
+		source:     source,
+		nameToUser: nameToUser,
+		idToUser:   idToUser}, nil
+}
+
+// One user as read from a users source.
+type userEntry struct {
+	// Where the user was read from, if not the source itself.
+	file string
+	// Line number in the users file, starting at one.  (For sources
+	// without lines, the position of the user in the source.)
+	line     int
+	id       int
+	name     string
+	groups   []string
+	disabled bool
+}
+
+// A UsersProblem is one thing wrong with a users file.
+type UsersProblem struct {
+	File string
+	Line int
+	Msg  string
+}
+
+// A UsersError lists every problem found in a users file, in line order.
+type UsersError struct {
+	File     string
+	Problems []UsersProblem
+}
+
+func (e *UsersError) Error() string {
+	msgs := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		msgs[i] = fmt.Sprintf("%s:%d: %s", p.File, p.Line, p.Msg)
+	}
+	return strings.Join(msgs, "\n")
+}
+
+func (e *UsersError) add(line int, format string, a ...interface{}) {
+	e.addIn("", line, format, a...)
+}
+
+// Add a problem found in file, or in e.File if file is empty.
+func (e *UsersError) addIn(file string, line int, format string, a ...interface{}) {
+	if file == "" {
+		file = e.File
+	}
+	e.Problems = append(e.Problems, UsersProblem{file, line, fmt.Sprintf(format, a...)})
+}
+
+// Parse the contents of a users file into a map of name to user.
+// Every problem in the file is reported in a single *UsersError.
+func parseUsers(data []byte, userfn string) (map[string]*vUser, error) {
+	problems := &UsersError{File: userfn}
+	return buildUsers(readUserEntries(data, problems), problems)
+}
+
+// Split the lines of a users file into entries.
+func readUserEntries(data []byte, problems *UsersError) []userEntry {
+
+	entries := make([]userEntry, 0)
 
 	lines := bytes.Split(data, []byte("\n"))
 	for idx, line := range lines {
@@ -165,62 +327,410 @@ func NewVusers(root string) (*vUsers, error) {
 		}
 
 		columns := bytes.Split(line, []byte(":"))
-		if len(columns) != 3 {
-			return nil, fmt.Errorf("Got %d columns (expected %d) on line %d of %s",
-				len(columns), 3, idx, userfn, string(line))
+		if len(columns) != 3 && len(columns) != 4 {
+			problems.add(idx+1, "got %d columns (expected 3 or 4)", len(columns))
+			continue
+		}
+
+		disabled := false
+		if len(columns) == 4 {
+			switch string(columns[3]) {
+			case "":
+			case disabledFlag:
+				disabled = true
+			default:
+				problems.add(idx+1, "unknown flag '%s'", columns[3])
+				continue
+			}
 		}
 
 		id, err := strconv.Atoi(string(columns[0]))
 		if err != nil {
-			return nil, fmt.Errorf("Can't parse first column as integer on line %d of %s",
-				len(columns), 3, idx, userfn, string(line))
+			problems.add(idx+1, "id '%s' is not an integer", columns[0])
+			continue
 		}
-		name := string(columns[1])
-		nameToUser[name] = &vUser{
-			id:      id,
-			name:    name,
-			members: make([]p.User, 0),
-			groups:  make([]p.Group, 0)}
+
+		groups := make([]string, 0)
+		for _, group := range bytes.Split(columns[2], []byte(",")) {
+			if len(group) > 0 {
+				groups = append(groups, string(group))
+			}
+		}
+
+		entries = append(entries, userEntry{"", idx + 1, id, string(columns[1]), groups, disabled})
 	}
 
-	// Load groups on second pass.
-	lines = bytes.Split(data, []byte("\n"))
-	for _, line := range lines {
-		if len(line) == 0 {
+	return entries
+}
+
+// Check the entries for duplicates and bad names, then link users
+// to their groups.  Problems are appended to the ones passed in.
+func buildUsers(entries []userEntry, problems *UsersError) (map[string]*vUser, error) {
+
+	nameToUser := make(map[string]*vUser)
+	// Index of the entry that first used a name or id.
+	nameFirst := make(map[string]int)
+	idFirst := make(map[int]int)
+
+	for i, e := range entries {
+		if err := checkName(e.name); err != nil {
+			problems.addIn(e.file, e.line, "%v", err)
 			continue
 		}
-		if line[0] == byte('#') {
+		// Id 0 is the host's root; nobody gets it here.
+		if e.id == 0 {
+			problems.addIn(e.file, e.line, "'%s' has id 0, which is reserved", e.name)
 			continue
 		}
-		columns := bytes.Split(line, []byte(":"))
-		name := string(columns[1])
-		groups := columns[2]
-		user, present := nameToUser[name]
-		if !present {
-			panic(fmt.Sprintf("can't find user '%s' after first pass", name))
-		}
-		groupNames := bytes.Split(groups, []byte(","))
-		for _, groupName := range groupNames {
-			if len(groupName) == 0 {
-				continue
-			}
-			group, present := nameToUser[string(groupName)]
+		if first, present := idFirst[e.id]; present {
+			problems.addIn(e.file, e.line, "duplicate id %d (first used on line %d)",
+				e.id, entries[first].line)
+			continue
+		}
+		if first, present := nameFirst[e.name]; present {
+			problems.addIn(e.file, e.line, "duplicate name '%s' (first used on line %d)",
+				e.name, entries[first].line)
+			continue
+		}
+		idFirst[e.id] = i
+		nameFirst[e.name] = i
+		nameToUser[e.name] = &vUser{
+			id:       e.id,
+			name:     e.name,
+			members:  make([]p.User, 0),
+			groups:   make([]p.Group, 0),
+			disabled: e.disabled}
+	}
+
+	// Load groups on second pass.
+	for i, e := range entries {
+		user, present := nameToUser[e.name]
+		if !present || nameFirst[e.name] != i {
+			continue
+		}
+		for _, groupName := range e.groups {
+			group, present := nameToUser[groupName]
 			if !present {
-				panic(fmt.Sprintf("can't find group name '%s' after first pass", groupName))
+				problems.addIn(e.file, e.line, "unknown group '%s'", groupName)
+				continue
 			}
 			user.groups = append(user.groups, group)
 			group.members = append(group.members, user)
 		}
 	}
 
-	// Create second map, of ID to user.
-	idToUser := make(map[int]*vUser, len(nameToUser))
+	findCycles(entries, nameToUser, problems)
+
+	if len(problems.Problems) > 0 {
+		sort.SliceStable(problems.Problems, func(i, j int) bool {
+			a, b := problems.Problems[i], problems.Problems[j]
+			if a.File != b.File {
+				return a.File < b.File
+			}
+			return a.Line < b.Line
+		})
+		return nil, problems
+	}
+
+	expandGroups(nameToUser)
+
+	return nameToUser, nil
+}
+
+// Report groups that are, through other groups, members of
+// themselves.  A user listed in its own group is fine.
+func findCycles(entries []userEntry, nameToUser map[string]*vUser, problems *UsersError) {
+
+	const (
+		unseen = iota
+		onPath
+		done
+	)
+	state := make(map[*vUser]int)
+	entry := make(map[*vUser]userEntry)
+	for _, e := range entries {
+		if u, present := nameToUser[e.name]; present {
+			if _, present := entry[u]; !present {
+				entry[u] = e
+			}
+		}
+	}
+
+	var path []*vUser
+	var visit func(u *vUser)
+	visit = func(u *vUser) {
+		state[u] = onPath
+		path = append(path, u)
+		for _, g := range u.groups {
+			group := g.(*vUser)
+			switch {
+			case group == u:
+				continue
+			case state[group] == onPath:
+				start := len(path) - 1
+				for path[start] != group {
+					start--
+				}
+				names := make([]string, 0)
+				for _, member := range path[start:] {
+					names = append(names, member.name)
+				}
+				names = append(names, group.name)
+				problems.addIn(entry[group].file, entry[group].line,
+					"group cycle: %s", strings.Join(names, " -> "))
+			case state[group] == unseen:
+				visit(group)
+			}
+		}
+		path = path[:len(path)-1]
+		state[u] = done
+	}
+
+	for _, e := range entries {
+		if u, present := nameToUser[e.name]; present && state[u] == unseen {
+			visit(u)
+		}
+	}
+}
+
+// Work out, for each user, every group it is in through nested groups.
+func expandGroups(nameToUser map[string]*vUser) {
+
 	for _, user := range nameToUser {
-		idToUser[user.Id()] = user
+		all := make([]p.Group, 0)
+		seen := map[p.Group]bool{}
+		queue := append([]p.Group(nil), user.Groups()...)
+		for len(queue) > 0 {
+			g := queue[0]
+			queue = queue[1:]
+			if seen[g] {
+				continue
+			}
+			seen[g] = true
+			all = append(all, g)
+			queue = append(queue, g.(*vUser).Groups()...)
+		}
+		user.Lock()
+		user.allGroups = all
+		user.Unlock()
 	}
+}
 
-	return &vUsers{
-		root:       root,
-		nameToUser: nameToUser,
-		idToUser:   idToUser}, nil
+// CheckUsers reads the users file under root, without creating it,
+// and returns a *UsersError listing any problems.
+func CheckUsers(root string) error {
+
+	userfn := filepath.Join(root, usersFile)
+
+	data, err := ioutil.ReadFile(userfn)
+	if err != nil {
+		return err
+	}
+
+	_, err = parseUsers(data, userfn)
+	return err
+}
+
+// Reload re-reads the users from their source.  Users are matched by
+// id, so the p.User values already handed out (for example, to
+// attached fids) pick up new names and group lists.
+func (up *vUsers) Reload() error {
+
+	problems := &UsersError{File: up.source.String()}
+
+	entries, err := up.source.load(problems)
+	if err != nil {
+		return err
+	}
+
+	fresh, err := buildUsers(entries, problems)
+	if err != nil {
+		return err
+	}
+
+	up.Lock()
+	defer up.Unlock()
+
+	// Keep the existing user for each id that survived.
+	canonical := make(map[*vUser]*vUser, len(fresh))
+	for _, user := range fresh {
+		if old, present := up.idToUser[user.id]; present {
+			canonical[user] = old
+		} else {
+			canonical[user] = user
+		}
+	}
+
+	nameToUser := make(map[string]*vUser, len(fresh))
+	idToUser := make(map[int]*vUser, len(fresh))
+	for name, user := range fresh {
+		c := canonical[user]
+		groups := make([]p.Group, 0, len(user.groups))
+		for _, g := range user.groups {
+			groups = append(groups, canonical[g.(*vUser)])
+		}
+		members := make([]p.User, 0, len(user.members))
+		for _, m := range user.members {
+			members = append(members, canonical[m.(*vUser)])
+		}
+		c.Lock()
+		c.name, c.groups, c.members = name, groups, members
+		c.disabled = user.disabled
+		c.Unlock()
+		nameToUser[name] = c
+		idToUser[c.id] = c
+	}
+
+	up.nameToUser, up.idToUser = nameToUser, idToUser
+
+	expandGroups(nameToUser)
+
+	return nil
+}
+
+// Check that a name can be stored in the users file.
+func checkName(name string) error {
+	if name == "" {
+		return fmt.Errorf("empty user name")
+	}
+	for _, c := range badUsernameChar {
+		if strings.ContainsRune(name, c) {
+			return fmt.Errorf("user name '%s' contains '%c'", name, c)
+		}
+	}
+	// Ids that aren't users are shown as numbers; a name must not
+	// look like one.
+	if strings.Trim(name, "0123456789") == "" {
+		return fmt.Errorf("user name '%s' is a number", name)
+	}
+	return nil
+}
+
+// Rename changes the name of a user (and of the group with the same
+// id).  Files record the numeric id, so they follow the user to the
+// new name without any .uidgid file being rewritten.
+func (up *vUsers) Rename(oldname, newname string) error {
+
+	if err := checkName(newname); err != nil {
+		return err
+	}
+
+	source, ok := up.source.(*fileSource)
+	if !ok {
+		return fmt.Errorf("can't rename users in %s", up.source)
+	}
+
+	up.Lock()
+	defer up.Unlock()
+
+	user, present := up.nameToUser[oldname]
+	if !present {
+		return fmt.Errorf("no user named '%s'", oldname)
+	}
+	if _, present := up.nameToUser[newname]; present {
+		return fmt.Errorf("user '%s' already exists", newname)
+	}
+
+	rename := func(name string) string {
+		if name == oldname {
+			return newname
+		}
+		return name
+	}
+	err := rewriteUserFile(source.String(), func(columns []string) []string {
+		columns[1] = rename(columns[1])
+		groups := strings.Split(columns[2], ",")
+		for i := range groups {
+			if groups[i] != "" {
+				groups[i] = rename(groups[i])
+			}
+		}
+		columns[2] = strings.Join(groups, ",")
+		return columns
+	})
+	if err != nil {
+		return err
+	}
+
+	delete(up.nameToUser, oldname)
+	user.Lock()
+	user.name = newname
+	user.Unlock()
+	up.nameToUser[newname] = user
+
+	return nil
+}
+
+// Rewrite the users file by replacing the columns of each user's
+// line with what edit returns.  Comments are left alone.  The new
+// contents are written to a temporary file that is then renamed
+// over the original.
+func rewriteUserFile(userfn string, edit func(columns []string) []string) error {
+
+	data, err := ioutil.ReadFile(userfn)
+	if err != nil {
+		return err
+	}
+
+	lines := strings.Split(string(data), "\n")
+	for idx, line := range lines {
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		columns := strings.Split(line, ":")
+		if len(columns) < 3 {
+			continue
+		}
+		lines[idx] = strings.Join(edit(columns), ":")
+	}
+
+	tmpfn := userfn + ".tmp"
+	err = ioutil.WriteFile(tmpfn, []byte(strings.Join(lines, "\n")), 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpfn, userfn)
+}
+
+// SetDisabled locks a user out (or lets them back in) and records
+// this in adm/users.  The user keeps its id and still owns its files.
+// Disabling a user doesn't end its sessions; see VuFs.DisableUser.
+func (up *vUsers) SetDisabled(name string, disabled bool) error {
+
+	source, ok := up.source.(*fileSource)
+	if !ok {
+		return fmt.Errorf("can't disable users in %s", up.source)
+	}
+
+	up.Lock()
+	defer up.Unlock()
+
+	user, present := up.nameToUser[name]
+	if !present {
+		return fmt.Errorf("no user named '%s'", name)
+	}
+
+	flag := ""
+	if disabled {
+		flag = disabledFlag
+	}
+	err := rewriteUserFile(source.String(), func(columns []string) []string {
+		if columns[1] != name {
+			return columns
+		}
+		if flag == "" {
+			return columns[:3]
+		}
+		return append(columns[:3], flag)
+	})
+	if err != nil {
+		return err
+	}
+
+	user.Lock()
+	user.disabled = disabled
+	user.Unlock()
+
+	return nil
 }
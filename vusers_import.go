@@ -0,0 +1,175 @@
+package vufs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The id given to adm when importing into a tree without adm/users.
+// It sits just below the ids of host groups, so it won't collide with
+// a host uid or gid.
+const importAdmId = hostGroupBase - 1
+
+// Merge host users into the contents of a users file.  Users already
+// in the file keep their ids and gain any host groups they are
+// missing; new users get their host ids.  Host users that can't be
+// added (bad names, ids already taken) are skipped and reported,
+// along with ids that differ between the file and the host.  The
+// host's adm user and group have nothing to do with vufs' adm, so
+// they are skipped too, and nobody joins adm by import; so are root
+// and its group (id 0).
+func mergeUsers(current []byte, userfn string, host []userEntry) ([]byte, []UsersProblem, error) {
+
+	if _, err := parseUsers(current, userfn); err != nil {
+		return nil, nil, err
+	}
+	entries := readUserEntries(current, &UsersError{File: userfn})
+
+	conflicts := &UsersError{}
+	byName := make(map[string]int)
+	idName := make(map[int]string)
+	for i, e := range entries {
+		byName[e.name] = i
+		idName[e.id] = e.name
+	}
+
+	// Add the users, then their groups, so a group can come after
+	// its members.
+	added := len(entries)
+	for _, h := range host {
+		if h.name == admUser {
+			conflicts.addIn(h.file, h.line, "host '%s' is not vufs' %s; not imported", h.name, admUser)
+			continue
+		}
+		if h.id == 0 || h.id == hostGroupBase {
+			conflicts.addIn(h.file, h.line, "'%s' has the host's id 0; not imported", h.name)
+			continue
+		}
+		if i, present := byName[h.name]; present {
+			if entries[i].id != h.id {
+				conflicts.addIn(h.file, h.line, "'%s' is id %d in %s; keeping it instead of %d",
+					h.name, entries[i].id, userfn, h.id)
+			}
+			continue
+		}
+		if err := checkName(h.name); err != nil {
+			conflicts.addIn(h.file, h.line, "%v; not imported", err)
+			continue
+		}
+		if name, present := idName[h.id]; present {
+			conflicts.addIn(h.file, h.line, "id %d of '%s' is already used by '%s'; not imported",
+				h.id, h.name, name)
+			continue
+		}
+		byName[h.name] = len(entries)
+		idName[h.id] = h.name
+		entries = append(entries, userEntry{h.file, h.line, h.id, h.name, make([]string, 0), h.disabled})
+	}
+
+	for _, h := range host {
+		i, present := byName[h.name]
+		if !present || h.name == admUser {
+			continue
+		}
+		for _, group := range h.groups {
+			if group == admUser {
+				conflicts.addIn(h.file, h.line, "'%s' is in the host's %s group; not added to vufs' %s",
+					h.name, admUser, admUser)
+				continue
+			}
+			if _, present := byName[group]; !present {
+				conflicts.addIn(h.file, h.line, "group '%s' of '%s' was not imported", group, h.name)
+				continue
+			}
+			if !containsString(entries[i].groups, group) {
+				entries[i].groups = append(entries[i].groups, group)
+			}
+		}
+	}
+
+	// Rewrite the lines already in the file, so comments stay put,
+	// and add the new users at the end.
+	lines := strings.Split(strings.TrimSuffix(string(current), "\n"), "\n")
+	if len(current) == 0 {
+		lines = lines[:0]
+	}
+	format := func(e userEntry) string {
+		line := fmt.Sprintf("%d:%s:%s", e.id, e.name, strings.Join(e.groups, ","))
+		if e.disabled {
+			line += ":" + disabledFlag
+		}
+		return line
+	}
+	for _, e := range entries[:added] {
+		lines[e.line-1] = format(e)
+	}
+	for _, e := range entries[added:] {
+		lines = append(lines, format(e))
+	}
+	merged := []byte(strings.Join(lines, "\n") + "\n")
+
+	if _, err := parseUsers(merged, userfn); err != nil {
+		return nil, nil, err
+	}
+
+	return merged, conflicts.Problems, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ImportUsers merges the users and groups in passwd(5) and group(5)
+// format files into adm/users under root, creating it (with just
+// adm) if needed.  It returns the merged file and anything that
+// could not be imported.  Unless dryrun is set, the merged file
+// replaces adm/users.
+func ImportUsers(root, passwd, group string, dryrun bool) ([]byte, []UsersProblem, error) {
+
+	userfn := filepath.Join(root, usersFile)
+
+	current, err := ioutil.ReadFile(userfn)
+	if os.IsNotExist(err) {
+		current, err = []byte(fmt.Sprintf("%d:adm:\n", importAdmId)), nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	problems := &UsersError{File: passwd}
+	host, err := (&unixSource{passwd, group}).load(problems)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	merged, conflicts, err := mergeUsers(current, userfn, host)
+	if err != nil {
+		return nil, nil, err
+	}
+	conflicts = append(problems.Problems, conflicts...)
+
+	if dryrun {
+		return merged, conflicts, nil
+	}
+
+	err = os.MkdirAll(filepath.Dir(userfn), 0700)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tmpfn := userfn + ".tmp"
+	err = ioutil.WriteFile(tmpfn, merged, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return merged, conflicts, os.Rename(tmpfn, userfn)
+}
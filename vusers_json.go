@@ -0,0 +1,62 @@
+package vufs
+
+import (
+	"encoding/json"
+	"io/ioutil"
+)
+
+// Users read from a JSON file that holds a list of users:
+//
+//	[
+//		{"id": 1, "name": "adm", "groups": ["sys"]},
+//		{"id": 4, "name": "sys"},
+//		{"id": 7, "name": "bob", "disabled": true}
+//	]
+//
+// Problems are reported by position in the list, starting at one.
+type jsonSource struct {
+	file string
+}
+
+type jsonUser struct {
+	Id       *int     `json:"id"`
+	Name     string   `json:"name"`
+	Groups   []string `json:"groups"`
+	Disabled bool     `json:"disabled"`
+}
+
+func (s *jsonSource) String() string { return s.file }
+
+func (s *jsonSource) load(problems *UsersError) ([]userEntry, error) {
+
+	data, err := ioutil.ReadFile(s.file)
+	if err != nil {
+		return nil, err
+	}
+
+	var users []jsonUser
+	err = json.Unmarshal(data, &users)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]userEntry, 0, len(users))
+	for idx, u := range users {
+		if u.Id == nil {
+			problems.add(idx+1, "user '%s' has no id", u.Name)
+			continue
+		}
+		groups := u.Groups
+		if groups == nil {
+			groups = make([]string, 0)
+		}
+		entries = append(entries, userEntry{"", idx + 1, *u.Id, u.Name, groups, u.Disabled})
+	}
+
+	return entries, nil
+}
+
+// NewJSONUsers returns the users listed in a JSON file.
+func NewJSONUsers(file string) (*vUsers, error) {
+	return newUsers(&jsonSource{file})
+}
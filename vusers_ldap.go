@@ -0,0 +1,415 @@
+package vufs
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Just enough LDAPv3 (RFC 4511) to bind and search for posixAccount and
+posixGroup entries (RFC 2307).  Messages are BER encoded; we only
+use definite lengths, and only the types below.
+*/
+
+const (
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berEnumerated  = 0x0a
+	berBoolean     = 0x01
+	berSequence    = 0x30
+	berSet         = 0x31
+
+	ldapBindRequest     = 0x60
+	ldapBindResponse    = 0x61
+	ldapUnbindRequest   = 0x42
+	ldapSearchRequest   = 0x63
+	ldapSearchEntry     = 0x64
+	ldapSearchDone      = 0x65
+	ldapSearchReference = 0x73
+	ldapSimpleAuth      = 0x80
+	ldapEqualityMatch   = 0xa3
+
+	ldapScopeSubtree = 2
+	ldapTimeout      = 30 * time.Second
+
+	// The largest value we will read, so a bad length can't make
+	// us allocate gigabytes.
+	ldapMaxMessage = 16 << 20
+)
+
+// One BER type-length-value.
+type berTLV struct {
+	tag   byte
+	value []byte
+}
+
+func berLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	b := make([]byte, 0, 4)
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+// Encode a value whose contents are the concatenation of parts.
+func berEncode(tag byte, parts ...[]byte) []byte {
+	n := 0
+	for _, part := range parts {
+		n += len(part)
+	}
+	b := append([]byte{tag}, berLength(n)...)
+	for _, part := range parts {
+		b = append(b, part...)
+	}
+	return b
+}
+
+func berInt(tag byte, n int) []byte {
+	b := []byte{byte(n)}
+	for n >>= 8; n != 0 && n != -1; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	// Keep the sign bit right.
+	if n == 0 && b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	if n == -1 && b[0]&0x80 == 0 {
+		b = append([]byte{0xff}, b...)
+	}
+	return berEncode(tag, b)
+}
+
+func berString(tag byte, s string) []byte {
+	return berEncode(tag, []byte(s))
+}
+
+func berIntValue(value []byte) int {
+	n := 0
+	for i, b := range value {
+		if i == 0 && b&0x80 != 0 {
+			n = -1
+		}
+		n = n<<8 | int(b)
+	}
+	return n
+}
+
+// Read one value from r.
+func berRead(r *bufio.Reader) (berTLV, error) {
+
+	tag, err := r.ReadByte()
+	if err != nil {
+		return berTLV{}, err
+	}
+
+	n, err := r.ReadByte()
+	if err == io.EOF {
+		return berTLV{}, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return berTLV{}, err
+	}
+
+	length := int(n)
+	if n&0x80 != 0 {
+		if n&0x7f > 4 {
+			return berTLV{}, fmt.Errorf("ldap: length of %d bytes is too long", n&0x7f)
+		}
+		length = 0
+		for i := 0; i < int(n&0x7f); i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return berTLV{}, err
+			}
+			length = length<<8 | int(b)
+		}
+	}
+
+	if length < 0 || length > ldapMaxMessage {
+		return berTLV{}, fmt.Errorf("ldap: message of %d bytes is too long", length)
+	}
+
+	value := make([]byte, length)
+	_, err = io.ReadFull(r, value)
+	return berTLV{tag, value}, err
+}
+
+// Split the contents of a constructed value into its parts.
+func berSplit(value []byte) ([]berTLV, error) {
+	parts := make([]berTLV, 0)
+	r := bufio.NewReader(bytes.NewReader(value))
+	for {
+		tlv, err := berRead(r)
+		if err == io.EOF {
+			return parts, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("ldap: malformed message: %v", err)
+		}
+		parts = append(parts, tlv)
+	}
+}
+
+// A connection to an LDAP server.
+type ldapConn struct {
+	conn  net.Conn
+	r     *bufio.Reader
+	msgid int
+}
+
+func dialLDAP(addr string) (*ldapConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, ldapTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(ldapTimeout))
+	return &ldapConn{conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+func (c *ldapConn) Close() error {
+	c.send(berEncode(ldapUnbindRequest))
+	return c.conn.Close()
+}
+
+// Send a protocol operation in a new message.
+func (c *ldapConn) send(op []byte) error {
+	c.msgid++
+	_, err := c.conn.Write(berEncode(berSequence, berInt(berInteger, c.msgid), op))
+	return err
+}
+
+// Receive the next protocol operation for the last message sent.
+func (c *ldapConn) recv() (berTLV, error) {
+	for {
+		msg, err := berRead(c.r)
+		if err != nil {
+			return berTLV{}, err
+		}
+		parts, err := berSplit(msg.value)
+		if err != nil {
+			return berTLV{}, err
+		}
+		if msg.tag != berSequence || len(parts) < 2 || parts[0].tag != berInteger {
+			return berTLV{}, fmt.Errorf("ldap: malformed message")
+		}
+		if berIntValue(parts[0].value) == c.msgid {
+			return parts[1], nil
+		}
+	}
+}
+
+// Check the LDAPResult in a response.
+func ldapResult(op berTLV) error {
+	parts, err := berSplit(op.value)
+	if err != nil {
+		return err
+	}
+	if len(parts) < 3 || parts[0].tag != berEnumerated {
+		return fmt.Errorf("ldap: malformed result")
+	}
+	if code := berIntValue(parts[0].value); code != 0 {
+		return fmt.Errorf("ldap: result code %d: %s", code, parts[2].value)
+	}
+	return nil
+}
+
+// Simple bind.  An empty dn and password is an anonymous bind.
+func (c *ldapConn) bind(dn, password string) error {
+
+	err := c.send(berEncode(ldapBindRequest,
+		berInt(berInteger, 3),
+		berString(berOctetString, dn),
+		berString(ldapSimpleAuth, password)))
+	if err != nil {
+		return err
+	}
+
+	op, err := c.recv()
+	if err != nil {
+		return err
+	}
+	if op.tag != ldapBindResponse {
+		return fmt.Errorf("ldap: expected bind response, got tag %#x", op.tag)
+	}
+	return ldapResult(op)
+}
+
+// Return the attributes of every entry under base of the given
+// objectClass, by lower-case name.
+func (c *ldapConn) search(base, class string, attrs ...string) ([]map[string][]string, error) {
+
+	attrList := make([][]byte, len(attrs))
+	for i, a := range attrs {
+		attrList[i] = berString(berOctetString, a)
+	}
+
+	err := c.send(berEncode(ldapSearchRequest,
+		berString(berOctetString, base),
+		berInt(berEnumerated, ldapScopeSubtree),
+		berInt(berEnumerated, 0),
+		berInt(berInteger, 0),
+		berInt(berInteger, 0),
+		berEncode(berBoolean, []byte{0}),
+		berEncode(ldapEqualityMatch,
+			berString(berOctetString, "objectClass"),
+			berString(berOctetString, class)),
+		berEncode(berSequence, attrList...)))
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]map[string][]string, 0)
+	for {
+		op, err := c.recv()
+		if err != nil {
+			return nil, err
+		}
+
+		switch op.tag {
+		case ldapSearchDone:
+			return entries, ldapResult(op)
+
+		case ldapSearchReference:
+			continue
+
+		case ldapSearchEntry:
+			parts, err := berSplit(op.value)
+			if err != nil {
+				return nil, err
+			}
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("ldap: malformed search entry")
+			}
+			attributes, err := berSplit(parts[1].value)
+			if err != nil {
+				return nil, err
+			}
+			entry := make(map[string][]string)
+			for _, attr := range attributes {
+				typeVals, err := berSplit(attr.value)
+				if err != nil || len(typeVals) != 2 {
+					return nil, fmt.Errorf("ldap: malformed attribute")
+				}
+				vals, err := berSplit(typeVals[1].value)
+				if err != nil {
+					return nil, err
+				}
+				// Attribute names are case-insensitive.
+				name := strings.ToLower(string(typeVals[0].value))
+				for _, v := range vals {
+					entry[name] = append(entry[name], string(v.value))
+				}
+			}
+			entries = append(entries, entry)
+
+		default:
+			return nil, fmt.Errorf("ldap: unexpected tag %#x in search", op.tag)
+		}
+	}
+}
+
+// Users read from posixAccount and posixGroup entries in an LDAP
+// directory.  Problems are reported by position in the search
+// results, users first, then groups.
+type ldapSource struct {
+	addr     string
+	base     string
+	binddn   string
+	password string
+}
+
+func (s *ldapSource) String() string { return "ldap://" + s.addr + "/" + s.base }
+
+// The first value of an attribute as an integer.
+func ldapInt(entry map[string][]string, attr string) (int, error) {
+	vals := entry[strings.ToLower(attr)]
+	if len(vals) == 0 {
+		return 0, fmt.Errorf("no %s", attr)
+	}
+	n, err := strconv.Atoi(vals[0])
+	if err != nil {
+		return 0, fmt.Errorf("%s '%s' is not an integer", attr, vals[0])
+	}
+	return n, nil
+}
+
+func (s *ldapSource) load(problems *UsersError) ([]userEntry, error) {
+
+	c, err := dialLDAP(s.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	err = c.bind(s.binddn, s.password)
+	if err != nil {
+		return nil, err
+	}
+
+	accounts, err := c.search(s.base, "posixAccount", "uid", "uidNumber", "gidNumber")
+	if err != nil {
+		return nil, err
+	}
+
+	posixGroups, err := c.search(s.base, "posixGroup", "cn", "gidNumber", "memberUid")
+	if err != nil {
+		return nil, err
+	}
+
+	users := make([]hostUser, 0, len(accounts))
+	for idx, a := range accounts {
+		line := idx + 1
+		if len(a["uid"]) == 0 {
+			problems.add(line, "posixAccount has no uid")
+			continue
+		}
+		uid, err := ldapInt(a, "uidNumber")
+		if err != nil {
+			problems.add(line, "%s: %v", a["uid"][0], err)
+			continue
+		}
+		gid, err := ldapInt(a, "gidNumber")
+		if err != nil {
+			problems.add(line, "%s: %v", a["uid"][0], err)
+			continue
+		}
+		users = append(users, hostUser{"", line, a["uid"][0], uid, gid})
+	}
+
+	groups := make([]hostGroup, 0, len(posixGroups))
+	for idx, g := range posixGroups {
+		line := len(accounts) + idx + 1
+		if len(g["cn"]) == 0 {
+			problems.add(line, "posixGroup has no cn")
+			continue
+		}
+		gid, err := ldapInt(g, "gidNumber")
+		if err != nil {
+			problems.add(line, "%s: %v", g["cn"][0], err)
+			continue
+		}
+		members := g["memberuid"]
+		if members == nil {
+			members = make([]string, 0)
+		}
+		groups = append(groups, hostGroup{"", line, g["cn"][0], gid, members})
+	}
+
+	return hostEntries(users, groups), nil
+}
+
+// NewLDAPUsers returns the posixAccount users and posixGroup groups
+// under base in the LDAP directory at addr (host:port).  An empty
+// binddn binds anonymously.
+func NewLDAPUsers(addr, base, binddn, password string) (*vUsers, error) {
+	return newUsers(&ldapSource{addr, base, binddn, password})
+}
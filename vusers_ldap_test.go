@@ -0,0 +1,154 @@
+/*
+   Copyright (c) 2015, Mark Bucciarelli <mkbucc@gmail.com>
+*/
+
+package vufs
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+)
+
+// A stand-in LDAP server that answers binds and objectClass searches
+// from a fixed list of entries.
+type ldapStandIn struct {
+	listener net.Listener
+	password string
+	entries  []map[string][]string
+}
+
+func newLDAPStandIn(t *testing.T, password string, entries []map[string][]string) *ldapStandIn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &ldapStandIn{l, password, entries}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *ldapStandIn) Close() { s.listener.Close() }
+
+func (s *ldapStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	result := func(msgid int, tag byte, code int) {
+		conn.Write(berEncode(berSequence, berInt(berInteger, msgid),
+			berEncode(tag,
+				berInt(berEnumerated, code),
+				berString(berOctetString, ""),
+				berString(berOctetString, ""))))
+	}
+
+	for {
+		msg, err := berRead(r)
+		if err != nil {
+			return
+		}
+		parts, err := berSplit(msg.value)
+		if err != nil || len(parts) < 2 {
+			return
+		}
+		msgid, op := berIntValue(parts[0].value), parts[1]
+
+		switch op.tag {
+		case ldapUnbindRequest:
+			return
+
+		case ldapBindRequest:
+			fields, _ := berSplit(op.value)
+			code := 0
+			if string(fields[2].value) != s.password {
+				code = 49 // invalidCredentials
+			}
+			result(msgid, ldapBindResponse, code)
+
+		case ldapSearchRequest:
+			fields, _ := berSplit(op.value)
+			filter, _ := berSplit(fields[6].value)
+			class := string(filter[1].value)
+			for _, entry := range s.entries {
+				if entry["objectClass"][0] != class {
+					continue
+				}
+				attrs := make([]byte, 0)
+				for name, vals := range entry {
+					set := make([]byte, 0)
+					for _, v := range vals {
+						set = append(set, berString(berOctetString, v)...)
+					}
+					attrs = append(attrs, berEncode(berSequence,
+						berString(berOctetString, name),
+						berEncode(berSet, set))...)
+				}
+				conn.Write(berEncode(berSequence, berInt(berInteger, msgid),
+					berEncode(ldapSearchEntry,
+						berString(berOctetString, "cn="+entry["cn"][0]),
+						berEncode(berSequence, attrs))))
+			}
+			result(msgid, ldapSearchDone, 0)
+		}
+	}
+}
+
+var ldapEntries = []map[string][]string{
+	{"objectClass": {"posixAccount"}, "cn": {"ann"}, "uid": {"ann"}, "uidNumber": {"1001"}, "gidNumber": {"1001"}},
+	{"objectClass": {"posixAccount"}, "cn": {"bob"}, "UID": {"bob"}, "uidnumber": {"1002"}, "GIDNumber": {"100"}},
+	{"objectClass": {"posixGroup"}, "cn": {"ann"}, "gidNumber": {"1001"}},
+	{"objectClass": {"posixGroup"}, "cn": {"users"}, "gidNumber": {"100"}},
+	{"objectClass": {"posixGroup"}, "cn": {"eng"}, "gidNumber": {"200"}, "memberuid": {"ann", "bob"}},
+}
+
+func TestLDAPUsers(t *testing.T) {
+
+	s := newLDAPStandIn(t, "secret", ldapEntries)
+	defer s.Close()
+
+	addr := s.listener.Addr().String()
+
+	if _, err := NewLDAPUsers(addr, "dc=example", "cn=vufs", "wrong"); err == nil {
+		t.Error("NewLDAPUsers() succeeded with a bad password")
+	}
+
+	users, err := NewLDAPUsers(addr, "dc=example", "cn=vufs", "secret")
+	if err != nil {
+		t.Fatalf("NewLDAPUsers(): %v\n", err)
+	}
+
+	ann := users.Uname2User("ann")
+	if ann == nil || ann.Id() != 1001 {
+		t.Fatal("ann not loaded with id 1001")
+	}
+
+	eng := users.Gname2Group("eng")
+	if eng == nil || eng.Id() != hostGroupBase+200 {
+		t.Fatal("group eng not loaded")
+	}
+	if !ann.IsMember(eng) {
+		t.Error("ann not in eng")
+	}
+
+	bob := users.Uname2User("bob")
+	if bob == nil || !bob.IsMember(users.Gname2Group("users")) {
+		t.Error("bob not in his primary group users")
+	}
+}
+
+func TestBerReadTooLong(t *testing.T) {
+	// A sequence claiming to be 2 GB long.
+	r := bufio.NewReader(bytes.NewReader([]byte{berSequence, 0x84, 0x7f, 0xff, 0xff, 0xff, 0}))
+	if _, err := berRead(r); err == nil {
+		t.Error("berRead() accepted a 2 GB length")
+	}
+}
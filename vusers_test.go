@@ -5,7 +5,12 @@
 package vufs
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+
+	"github.com/lionkov/go9p/p"
 )
 
 func TestUserFileLoaded(t *testing.T) {
@@ -56,3 +61,596 @@ func TestUserFileLoaded(t *testing.T) {
 		}
 	}
 }
+
+// Copy test/adm/users to a scratch root so tests can modify it.
+func scratchUsers(t *testing.T) string {
+
+	root, err := ioutil.TempDir("", "vusers")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile("test/" + usersFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.MkdirAll(filepath.Join(root, "adm"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(root, usersFile), data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return root
+}
+
+func TestRename(t *testing.T) {
+
+	root := scratchUsers(t)
+	defer os.RemoveAll(root)
+
+	users, err := NewVusers(root)
+	if err != nil {
+		t.Fatalf("NewVusers(%s): %v\n", root, err)
+	}
+
+	glenda := users.Uname2User("glenda")
+
+	if err = users.Rename("glenda", "gnot"); err != nil {
+		t.Fatalf("Rename(glenda, gnot): %v\n", err)
+	}
+
+	if users.Uname2User("glenda") != nil {
+		t.Error("glenda still found by name after rename")
+	}
+	if u := users.Uid2User(5); u == nil || u.Name() != "gnot" {
+		t.Error("users.Uid2User(5) is not gnot")
+	}
+	if glenda.Name() != "gnot" {
+		t.Errorf("existing user value has name '%s', not gnot\n", glenda.Name())
+	}
+
+	// Renaming a group shows up in its members' group lists.
+	if err = users.Rename("sys", "system"); err != nil {
+		t.Fatalf("Rename(sys, system): %v\n", err)
+	}
+	if g := users.Uname2User("mark").Groups()[1]; g.Name() != "system" {
+		t.Errorf("mark: second group is '%s', not system\n", g.Name())
+	}
+
+	// The new names were written to disk.
+	reread, err := NewVusers(root)
+	if err != nil {
+		t.Fatalf("NewVusers(%s): %v\n", root, err)
+	}
+	if u := reread.Uid2User(5); u == nil || u.Name() != "gnot" {
+		t.Error("rename of glenda was not saved")
+	}
+	if u := reread.Uname2User("mark"); u == nil || u.Groups()[1].Name() != "system" {
+		t.Error("rename of sys was not saved in mark's groups")
+	}
+}
+
+func TestRenameRejected(t *testing.T) {
+
+	root := scratchUsers(t)
+	defer os.RemoveAll(root)
+
+	users, err := NewVusers(root)
+	if err != nil {
+		t.Fatalf("NewVusers(%s): %v\n", root, err)
+	}
+
+	for _, tt := range [][2]string{
+		{"nobody", "somebody"},
+		{"glenda", "mark"},
+		{"glenda", ""},
+		{"glenda", "gle:nda"},
+		{"glenda", "gle,nda"},
+		{"glenda", "9"},
+	} {
+		if err := users.Rename(tt[0], tt[1]); err == nil {
+			t.Errorf("Rename(%q, %q) was allowed\n", tt[0], tt[1])
+		}
+	}
+
+	if u := users.Uid2User(5); u.Name() != "glenda" {
+		t.Errorf("failed renames changed glenda to '%s'\n", u.Name())
+	}
+}
+
+func TestReload(t *testing.T) {
+
+	root := scratchUsers(t)
+	defer os.RemoveAll(root)
+
+	users, err := NewVusers(root)
+	if err != nil {
+		t.Fatalf("NewVusers(%s): %v\n", root, err)
+	}
+
+	mark := users.Uname2User("mark")
+
+	err = ioutil.WriteFile(filepath.Join(root, usersFile),
+		[]byte("1:adm:sys\n4:sys:\n6:marc:adm\n7:ken:\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = users.Reload(); err != nil {
+		t.Fatalf("Reload(): %v\n", err)
+	}
+
+	if mark.Name() != "marc" {
+		t.Errorf("existing user 6 has name '%s', not marc\n", mark.Name())
+	}
+	if len(mark.Groups()) != 1 || mark.Groups()[0].Name() != "adm" {
+		t.Error("existing user 6 should only be in group adm")
+	}
+	if users.Uname2User("ken") == nil {
+		t.Error("new user ken not loaded")
+	}
+	if users.Uname2User("glenda") != nil {
+		t.Error("removed user glenda still loaded")
+	}
+}
+
+func TestUsersProblems(t *testing.T) {
+
+	data := []byte(`# comment
+1:adm:sys
+2:adm:
+1:dup:
+x:bad:
+5:wh?at:
+6:mark:adm,nosuch
+7:too:many:columns
+8:sys:
+`)
+
+	_, err := parseUsers(data, "users")
+	if err == nil {
+		t.Fatal("parseUsers() found no problems")
+	}
+
+	uerr, ok := err.(*UsersError)
+	if !ok {
+		t.Fatalf("parseUsers() error is %T, not *UsersError\n", err)
+	}
+
+	expected := []int{3, 4, 5, 6, 7, 8}
+	if len(uerr.Problems) != len(expected) {
+		t.Fatalf("got %d problems, expected %d:\n%v\n",
+			len(uerr.Problems), len(expected), err)
+	}
+	for i, line := range expected {
+		if uerr.Problems[i].Line != line {
+			t.Errorf("problem %d is on line %d, expected %d: %s\n",
+				i, uerr.Problems[i].Line, line, uerr.Problems[i].Msg)
+		}
+	}
+}
+
+func TestCheckUsers(t *testing.T) {
+
+	if err := CheckUsers("./test"); err != nil {
+		t.Errorf("CheckUsers(./test): %v\n", err)
+	}
+
+	root := scratchUsers(t)
+	defer os.RemoveAll(root)
+
+	err := ioutil.WriteFile(filepath.Join(root, usersFile), []byte("1:adm:nosuch\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewVusers(root); err == nil {
+		t.Error("NewVusers() accepted an unknown group")
+	}
+	if err := CheckUsers(root); err == nil {
+		t.Error("CheckUsers() accepted an unknown group")
+	}
+}
+
+func TestUnknownGroup(t *testing.T) {
+
+	users, err := NewVusers("./test")
+	if err != nil {
+		t.Fatalf("NewVusers(./test): %v\n", err)
+	}
+
+	if g := users.Gid2Group(99); g != nil {
+		t.Errorf("Gid2Group(99) = %v, expected nil\n", g)
+	}
+
+	if g := users.Gname2Group("nosuch"); g != nil {
+		t.Errorf("Gname2Group(nosuch) = %v, expected nil\n", g)
+	}
+
+	if g := users.Gid2Group(4); g == nil || g.Name() != "sys" {
+		t.Error("Gid2Group(4) is not sys")
+	}
+}
+
+func TestNestedGroups(t *testing.T) {
+
+	data := []byte("1:adm:adm\n2:eng:\n3:backend:eng\n4:frontend:eng\n5:ann:backend\n6:bob:\n")
+
+	nameToUser, err := parseUsers(data, "users")
+	if err != nil {
+		t.Fatalf("parseUsers(): %v\n", err)
+	}
+
+	ann, eng, adm := nameToUser["ann"], nameToUser["eng"], nameToUser["adm"]
+
+	if len(ann.Groups()) != 1 {
+		t.Errorf("ann has %d direct groups, expected 1\n", len(ann.Groups()))
+	}
+	if !ann.IsMember(eng) {
+		t.Error("ann is not a member of eng through backend")
+	}
+	if nameToUser["bob"].IsMember(eng) {
+		t.Error("bob is a member of eng")
+	}
+	if !adm.IsMember(adm) {
+		t.Error("adm is not a member of itself")
+	}
+
+	f := &p.Dir{Uid: "adm", Gid: "eng", Mode: 0640}
+	if !CheckPerm(f, ann, p.DMREAD) {
+		t.Error("ann can't read file in group eng")
+	}
+	if CheckPerm(f, nameToUser["bob"], p.DMREAD) {
+		t.Error("bob can read file in group eng")
+	}
+}
+
+func TestGroupCycle(t *testing.T) {
+
+	data := []byte("1:adm:adm\n2:a:c\n3:b:a\n4:c:b\n")
+
+	_, err := parseUsers(data, "users")
+	if err == nil {
+		t.Fatal("parseUsers() accepted a group cycle")
+	}
+
+	uerr := err.(*UsersError)
+	if len(uerr.Problems) != 1 {
+		t.Fatalf("expected one problem, got:\n%v\n", err)
+	}
+	if uerr.Problems[0].Line != 2 || uerr.Problems[0].Msg != "group cycle: a -> c -> b -> a" {
+		t.Errorf("wrong problem: %v\n", err)
+	}
+}
+
+func TestJSONUsers(t *testing.T) {
+
+	root := scratchUsers(t)
+	defer os.RemoveAll(root)
+
+	fn := filepath.Join(root, "users.json")
+	err := ioutil.WriteFile(fn, []byte(`[
+		{"id": 1, "name": "adm", "groups": ["sys"]},
+		{"id": 4, "name": "sys"},
+		{"id": 6, "name": "mark", "groups": ["adm", "sys"]}
+	]`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users, err := NewJSONUsers(fn)
+	if err != nil {
+		t.Fatalf("NewJSONUsers(): %v\n", err)
+	}
+
+	if u := users.Uid2User(6); u == nil || u.Name() != "mark" || len(u.Groups()) != 2 {
+		t.Error("mark not loaded with two groups")
+	}
+
+	if err = users.Rename("mark", "marc"); err == nil {
+		t.Error("Rename() allowed for JSON users")
+	}
+
+	err = ioutil.WriteFile(fn, []byte(`[{"name": "adm"}, {"id": 2, "name": "x", "groups": ["y"]}]`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewJSONUsers(fn)
+	if uerr, ok := err.(*UsersError); !ok || len(uerr.Problems) != 2 {
+		t.Errorf("expected two problems, got %v\n", err)
+	}
+}
+
+func TestUnixUsers(t *testing.T) {
+
+	root := scratchUsers(t)
+	defer os.RemoveAll(root)
+
+	passwd := filepath.Join(root, "passwd")
+	err := ioutil.WriteFile(passwd, []byte(`root:x:0:0:root:/root:/bin/sh
+# comment
+ann:x:1001:1001:Ann:/home/ann:/bin/sh
+bob:x:1002:100::/home/bob:/bin/sh
+ops:x:1003:0::/home/ops:/bin/sh
++::::::
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	group := filepath.Join(root, "group")
+	err = ioutil.WriteFile(group, []byte(`root:x:0:
+users:x:100:
+ann:x:1001:
+eng:x:200:ann,bob,ghost
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users, err := NewUnixUsers(passwd, group)
+	if err != nil {
+		t.Fatalf("NewUnixUsers(): %v\n", err)
+	}
+
+	ann := users.Uname2User("ann")
+	if ann == nil || ann.Id() != 1001 {
+		t.Fatal("ann not loaded with id 1001")
+	}
+	if g := users.Gname2Group("ann"); g == nil || g.Id() != 1001 {
+		t.Error("group ann is not user ann")
+	}
+
+	eng := users.Gname2Group("eng")
+	if eng == nil || eng.Id() != hostGroupBase+200 {
+		t.Fatal("group eng not loaded")
+	}
+	if !ann.IsMember(eng) || !users.Uname2User("bob").IsMember(eng) {
+		t.Error("ann and bob should be in eng")
+	}
+	if !users.Uname2User("bob").IsMember(users.Gname2Group("users")) {
+		t.Error("bob not in his primary group")
+	}
+
+	// All sources feed the same permission check.
+	f := &p.Dir{Uid: "root", Gid: "eng", Mode: 0640}
+	if !CheckPerm(f, ann, p.DMREAD) || CheckPerm(f, ann, p.DMWRITE) {
+		t.Error("wrong permissions for ann on file in group eng")
+	}
+
+	// Nobody has id 0; root is only the host group.
+	if u := users.Uname2User("root"); u == nil || u.Id() != hostGroupBase {
+		t.Errorf("root is %v, not the host group\n", u)
+	}
+	ops := users.Uname2User("ops")
+	if ops == nil {
+		t.Fatal("ops not loaded")
+	}
+	f = &p.Dir{Uid: "bob", Gid: "bob", Mode: 0070}
+	if CheckPerm(f, ops, p.DMREAD) {
+		t.Error("ops, in gid 0, can read bob's file")
+	}
+
+	err = ioutil.WriteFile(filepath.Join(root, usersFile), []byte("1:adm:\n0:root:\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewVusers(root); err == nil {
+		t.Error("NewVusers() accepted id 0")
+	}
+
+	// A group named 9 would match files whose group 9 was deleted.
+	err = ioutil.WriteFile(filepath.Join(root, usersFile), []byte("1:adm:\n2:9:\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewVusers(root); err == nil {
+		t.Error("NewVusers() accepted the name '9'")
+	}
+}
+
+func TestImportUsers(t *testing.T) {
+
+	root := scratchUsers(t)
+	defer os.RemoveAll(root)
+
+	passwd := filepath.Join(root, "passwd")
+	err := ioutil.WriteFile(passwd, []byte(`root:x:0:0:root:/root:/bin/sh
+glenda:x:1001:1001::/home/glenda:/bin/rc
+ann:x:1002:100::/home/ann:/bin/sh
+bob:x:6:100::/home/bob:/bin/sh
+b:ad:x:1003:100::/home/bad:/bin/sh
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	group := filepath.Join(root, "group")
+	err = ioutil.WriteFile(group, []byte(`root:x:0:
+users:x:100:glenda
+glenda:x:1001:
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before, _ := ioutil.ReadFile(filepath.Join(root, usersFile))
+
+	_, conflicts, err := ImportUsers(root, passwd, group, true)
+	if err != nil {
+		t.Fatalf("ImportUsers(dryrun): %v\n", err)
+	}
+	after, _ := ioutil.ReadFile(filepath.Join(root, usersFile))
+	if string(before) != string(after) {
+		t.Error("dry run changed adm/users")
+	}
+
+	_, conflicts, err = ImportUsers(root, passwd, group, false)
+	if err != nil {
+		t.Fatalf("ImportUsers(): %v\n", err)
+	}
+
+	// glenda keeps id 5; bob's uid 6 belongs to mark; b:ad is
+	// malformed; root has id 0.
+	if len(conflicts) != 4 {
+		t.Errorf("expected 4 conflicts, got %d: %v\n", len(conflicts), conflicts)
+	}
+
+	users, err := NewVusers(root)
+	if err != nil {
+		t.Fatalf("NewVusers() after import: %v\n", err)
+	}
+
+	if u := users.Uname2User("glenda"); u == nil || u.Id() != 5 {
+		t.Error("glenda was renumbered")
+	}
+	if u := users.Uname2User("ann"); u == nil || u.Id() != 1002 {
+		t.Error("ann not imported with id 1002")
+	}
+	if users.Uname2User("bob") != nil {
+		t.Error("bob imported with mark's id")
+	}
+	if users.Uname2User("root") != nil {
+		t.Error("root imported")
+	}
+	users2 := users.Gname2Group("users")
+	if users2 == nil || !users.Uname2User("glenda").IsMember(users2) {
+		t.Error("glenda not added to group users")
+	}
+	if u := users.Uname2User("mark"); u == nil || len(u.Groups()) != 2 {
+		t.Error("mark's groups changed")
+	}
+
+	// Importing again changes nothing.
+	merged, _, err := ImportUsers(root, passwd, group, true)
+	if err != nil {
+		t.Fatalf("ImportUsers() again: %v\n", err)
+	}
+	current, _ := ioutil.ReadFile(filepath.Join(root, usersFile))
+	if string(merged) != string(current) {
+		t.Errorf("second import changed adm/users:\n%s\n", merged)
+	}
+}
+
+func TestImportHostAdm(t *testing.T) {
+
+	root := scratchUsers(t)
+	defer os.RemoveAll(root)
+
+	// The host's adm group has syslog and glenda in it.
+	passwd := filepath.Join(root, "passwd")
+	err := ioutil.WriteFile(passwd, []byte(`adm:x:3:4:adm:/var/adm:/bin/sh
+syslog:x:104:110::/home/syslog:/bin/false
+glenda:x:1001:1001::/home/glenda:/bin/rc
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	group := filepath.Join(root, "group")
+	err = ioutil.WriteFile(group, []byte("adm:x:4:syslog,glenda\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before, _ := NewVusers(root)
+	admGroups := len(before.Uname2User("adm").Groups())
+
+	if _, _, err = ImportUsers(root, passwd, group, false); err != nil {
+		t.Fatalf("ImportUsers(): %v\n", err)
+	}
+	users, err := NewVusers(root)
+	if err != nil {
+		t.Fatalf("NewVusers() after import: %v\n", err)
+	}
+
+	adm := users.Gname2Group("adm")
+	for _, name := range []string{"syslog", "glenda"} {
+		if u := users.Uname2User(name); u == nil || u.IsMember(adm) {
+			t.Errorf("%s is missing or in vufs' adm group: %v\n", name, u)
+		}
+	}
+	if u := users.Uname2User("adm"); u.Id() != before.Uname2User("adm").Id() || len(u.Groups()) != admGroups {
+		t.Errorf("vufs' adm took on the host's: id %d, groups %v\n", u.Id(), u.Groups())
+	}
+}
+
+func TestDisabled(t *testing.T) {
+
+	root := scratchUsers(t)
+	defer os.RemoveAll(root)
+
+	err := ioutil.WriteFile(filepath.Join(root, usersFile),
+		[]byte("1:adm:\n2:ann::disabled\n3:bob:adm:\n4:cy::locked\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewVusers(root); err == nil {
+		t.Error("NewVusers() accepted unknown flag 'locked'")
+	}
+
+	err = ioutil.WriteFile(filepath.Join(root, usersFile),
+		[]byte("1:adm:\n2:ann::disabled\n3:bob:adm:\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users, err := NewVusers(root)
+	if err != nil {
+		t.Fatalf("NewVusers(): %v\n", err)
+	}
+
+	ann, bob := users.Uname2User("ann"), users.Uname2User("bob")
+	if !isDisabled(ann) || isDisabled(bob) {
+		t.Fatal("only ann should be disabled")
+	}
+
+	if err = users.SetDisabled("bob", true); err != nil {
+		t.Fatalf("SetDisabled(bob, true): %v\n", err)
+	}
+	if err = users.SetDisabled("ann", false); err != nil {
+		t.Fatalf("SetDisabled(ann, false): %v\n", err)
+	}
+	if isDisabled(ann) || !isDisabled(bob) {
+		t.Error("SetDisabled() didn't change the users")
+	}
+
+	data, _ := ioutil.ReadFile(filepath.Join(root, usersFile))
+	if string(data) != "1:adm:\n2:ann:\n3:bob:adm:disabled\n" {
+		t.Errorf("wrong users file after SetDisabled:\n%s\n", data)
+	}
+
+	// A disabled user still has a name, but no permissions.
+	f := &p.Dir{Uid: "bob", Gid: "bob", Mode: 0777}
+	if bob.Name() != "bob" || CheckPerm(f, bob, p.DMREAD) {
+		t.Error("disabled bob can read")
+	}
+}
+
+func TestNoneNotAdmin(t *testing.T) {
+
+	root := scratchUsers(t)
+	defer os.RemoveAll(root)
+
+	err := ioutil.WriteFile(filepath.Join(root, usersFile), []byte("1:adm:\n2:none:adm\n3:bob:adm\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := NewVusers(root)
+	if err != nil {
+		t.Fatalf("NewVusers(): %v\n", err)
+	}
+
+	if !isAdmin(users.Uname2User("bob"), users) {
+		t.Error("bob, in group adm, isn't an admin")
+	}
+	if isAdmin(users.Uname2User("none"), users) {
+		t.Error("none, in group adm, is an admin")
+	}
+}
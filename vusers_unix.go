@@ -0,0 +1,190 @@
+package vufs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// Ids of host groups that aren't also host users start here.  The
+// host keeps uids and gids apart, but in vufs a user is a group, so
+// they share one id space.  Adding a fixed offset (rather than
+// picking the next free id) keeps the ids stable as users come and go.
+const hostGroupBase = 1 << 20
+
+// A user from a passwd(5)-style database.
+type hostUser struct {
+	file string
+	line int
+	name string
+	uid  int
+	// The user's primary group.
+	gid int
+}
+
+// A group from a group(5)-style database.
+type hostGroup struct {
+	file    string
+	line    int
+	name    string
+	gid     int
+	members []string
+}
+
+// Turn host users and groups into vufs users.  A group with the same
+// name as a user is that user.  Each user is in its primary group and
+// in every group that lists it as a member.  Members that aren't
+// users are skipped, as are primary groups that don't exist.  Root
+// (uid 0) is left out: it is nobody in particular in vufs, and id 0
+// is reserved.
+func hostEntries(users []hostUser, groups []hostGroup) []userEntry {
+
+	gidName := make(map[int]string)
+	for _, g := range groups {
+		if _, present := gidName[g.gid]; !present {
+			gidName[g.gid] = g.name
+		}
+	}
+
+	entries := make([]userEntry, 0, len(users)+len(groups))
+	index := make(map[string]int)
+	for _, u := range users {
+		if u.uid == 0 {
+			continue
+		}
+		if _, present := index[u.name]; !present {
+			index[u.name] = len(entries)
+		}
+		entries = append(entries, userEntry{u.file, u.line, u.uid, u.name, make([]string, 0), false})
+	}
+	for _, g := range groups {
+		if _, present := index[g.name]; !present {
+			index[g.name] = len(entries)
+			entries = append(entries, userEntry{g.file, g.line, hostGroupBase + g.gid, g.name, make([]string, 0), false})
+		}
+	}
+
+	join := func(user, group string) {
+		i, present := index[user]
+		if !present || user == group {
+			return
+		}
+		for _, g := range entries[i].groups {
+			if g == group {
+				return
+			}
+		}
+		entries[i].groups = append(entries[i].groups, group)
+	}
+
+	for _, u := range users {
+		if group, present := gidName[u.gid]; present {
+			join(u.name, group)
+		}
+	}
+	for _, g := range groups {
+		for _, member := range g.members {
+			join(member, g.name)
+		}
+	}
+
+	return entries
+}
+
+// Split a colon-separated host database into lines of columns,
+// skipping blank lines, comments and NIS "+" and "-" entries.
+func hostLines(data []byte, f func(line int, columns []string)) {
+	for idx, line := range bytes.Split(data, []byte("\n")) {
+		s := strings.TrimSpace(string(line))
+		if s == "" || s[0] == '#' || s[0] == '+' || s[0] == '-' {
+			continue
+		}
+		f(idx+1, strings.Split(s, ":"))
+	}
+}
+
+// Read users from passwd(5) data.
+func readPasswd(file string, data []byte, problems *UsersError) []hostUser {
+
+	users := make([]hostUser, 0)
+
+	hostLines(data, func(line int, columns []string) {
+		if len(columns) < 4 {
+			problems.addIn(file, line, "got %d columns (expected at least 4)", len(columns))
+			return
+		}
+		uid, err := strconv.Atoi(columns[2])
+		if err != nil {
+			problems.addIn(file, line, "uid '%s' is not an integer", columns[2])
+			return
+		}
+		gid, err := strconv.Atoi(columns[3])
+		if err != nil {
+			problems.addIn(file, line, "gid '%s' is not an integer", columns[3])
+			return
+		}
+		users = append(users, hostUser{file, line, columns[0], uid, gid})
+	})
+
+	return users
+}
+
+// Read groups from group(5) data.
+func readGroup(file string, data []byte, problems *UsersError) []hostGroup {
+
+	groups := make([]hostGroup, 0)
+
+	hostLines(data, func(line int, columns []string) {
+		if len(columns) != 4 {
+			problems.addIn(file, line, "got %d columns (expected 4)", len(columns))
+			return
+		}
+		gid, err := strconv.Atoi(columns[2])
+		if err != nil {
+			problems.addIn(file, line, "gid '%s' is not an integer", columns[2])
+			return
+		}
+		members := make([]string, 0)
+		for _, m := range strings.Split(columns[3], ",") {
+			if m != "" {
+				members = append(members, m)
+			}
+		}
+		groups = append(groups, hostGroup{file, line, columns[0], gid, members})
+	})
+
+	return groups
+}
+
+// Users read from the host's passwd and group files.
+type unixSource struct {
+	passwd string
+	group  string
+}
+
+func (s *unixSource) String() string { return s.passwd }
+
+func (s *unixSource) load(problems *UsersError) ([]userEntry, error) {
+
+	passwd, err := ioutil.ReadFile(s.passwd)
+	if err != nil {
+		return nil, err
+	}
+
+	group, err := ioutil.ReadFile(s.group)
+	if err != nil {
+		return nil, err
+	}
+
+	users := readPasswd(s.passwd, passwd, problems)
+	groups := readGroup(s.group, group, problems)
+
+	return hostEntries(users, groups), nil
+}
+
+// NewUnixUsers returns the users and groups in passwd(5) and group(5)
+// format files, usually /etc/passwd and /etc/group.
+func NewUnixUsers(passwd, group string) (*vUsers, error) {
+	return newUsers(&unixSource{passwd, group})
+}
@@ -0,0 +1,9 @@
+package vufs
+
+import "errors"
+
+// NewXattrStore returns a store that keeps Meta in user.vufs
+// extended attributes.  It is only supported on Linux.
+func NewXattrStore() (MetaStore, error) {
+	return nil, errors.New("xattr metadata is only supported on Linux")
+}
@@ -0,0 +1,90 @@
+package vufs
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The extended attribute that holds a file's Meta, and the version of
+// its format.
+const (
+	xattrName    = "user.vufs"
+	xattrVersion = 1
+)
+
+/*
+The xattr store keeps each file's Meta in an extended attribute of the
+file itself, so that tools that copy or back up the tree with
+extended attributes (cp -a, rsync -X, tar --xattrs) keep the virtual
+owners too.  The attribute is written in one call, so it is never half
+updated:
+
+	user.vufs=version uid gid [muid mode [key=value ...]]
+
+with the fields after the version as in a .uidgid file.
+
+The host file system must support user extended attributes (ext4,
+xfs, btrfs and, since Linux 6.6, tmpfs do).
+*/
+type xattrStore struct{}
+
+// NewXattrStore returns a store that keeps Meta in user.vufs
+// extended attributes.
+func NewXattrStore() (MetaStore, error) {
+	return xattrStore{}, nil
+}
+
+func (xattrStore) Get(path string, st os.FileInfo) (Meta, bool, error) {
+
+	buf := make([]byte, 128)
+	n, err := syscall.Getxattr(path, xattrName, buf)
+	if err == syscall.ERANGE {
+		// A long ACL.
+		if n, err = syscall.Getxattr(path, xattrName, nil); err == nil {
+			buf = make([]byte, n)
+			n, err = syscall.Getxattr(path, xattrName, buf)
+		}
+	}
+	if err == syscall.ENODATA || err == syscall.ENOENT {
+		return Meta{}, false, nil
+	}
+	if err != nil {
+		return Meta{}, false, &os.PathError{Op: "getxattr", Path: path, Err: err}
+	}
+
+	columns := strings.Fields(string(buf[:n]))
+	if len(columns) < 3 {
+		return Meta{}, false, fmt.Errorf("%s: bad %s '%s'", path, xattrName, buf[:n])
+	}
+	if v, err := strconv.Atoi(columns[0]); err != nil || v != xattrVersion {
+		return Meta{}, false, fmt.Errorf("%s: %s has unknown version '%s'", path, xattrName, columns[0])
+	}
+	m, err := parseMeta(columns[1:])
+	if err != nil {
+		return Meta{}, false, fmt.Errorf("%s: bad %s: %v", path, xattrName, err)
+	}
+
+	return m, true, nil
+}
+
+func (xattrStore) Set(path string, st os.FileInfo, m Meta) error {
+	value := fmt.Sprintf("%d %s", xattrVersion, strings.Join(m.columns(), " "))
+	err := syscall.Setxattr(path, xattrName, []byte(value), 0)
+	if err != nil {
+		return &os.PathError{Op: "setxattr", Path: path, Err: err}
+	}
+	return nil
+}
+
+// The attribute went with the file.
+func (xattrStore) Delete(path string, st os.FileInfo) error {
+	return nil
+}
+
+// The attribute goes with the file.
+func (xattrStore) Rename(oldpath, newpath string, st os.FileInfo) error {
+	return nil
+}
@@ -0,0 +1,100 @@
+package vufs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+// Run f in a scratch directory on each file system we expect to be
+// used: /tmp (often ext4) and /dev/shm (tmpfs).  File systems without
+// user extended attributes are skipped.
+func onXattrFileSystems(t *testing.T, f func(t *testing.T, dir string)) {
+	for _, parent := range []string{os.TempDir(), "/dev/shm"} {
+		t.Run(parent, func(t *testing.T) {
+			dir, err := ioutil.TempDir(parent, "vufs")
+			if err != nil {
+				t.Skip(err)
+			}
+			defer os.RemoveAll(dir)
+			err = syscall.Setxattr(dir, "user.vufs.probe", []byte("1"), 0)
+			if err != nil {
+				t.Skipf("no user xattrs in %s: %v", parent, err)
+			}
+			f(t, dir)
+		})
+	}
+}
+
+func TestXattrStore(t *testing.T) {
+	onXattrFileSystems(t, func(t *testing.T, dir string) {
+
+		store, _ := NewXattrStore()
+		fn := filepath.Join(dir, "a")
+		if err := ioutil.WriteFile(fn, []byte{}, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, found, err := store.Get(fn, nil); found || err != nil {
+			t.Errorf("new file has Meta: %v, %v\n", found, err)
+		}
+
+		m := Meta{Uid: 2, Gid: 3, Muid: 4, Mode: 0x40000000}
+		if err := store.Set(fn, nil, m); err != nil {
+			t.Fatalf("Set(%s): %v\n", fn, err)
+		}
+
+		// The Meta goes where the file goes.
+		moved := filepath.Join(dir, "b")
+		os.Rename(fn, moved)
+		got, found, err := store.Get(moved, nil)
+		if err != nil || !found || !reflect.DeepEqual(got, m) {
+			t.Errorf("Get(%s) = %v, %v, %v; expected %v\n", moved, got, found, err, m)
+		}
+
+		syscall.Setxattr(moved, xattrName, []byte("9 2 3 4 0x0"), 0)
+		if _, _, err = store.Get(moved, nil); err == nil {
+			t.Error("unknown version was accepted")
+		}
+	})
+}
+
+func TestConvertXattr(t *testing.T) {
+	onXattrFileSystems(t, func(t *testing.T, dir string) {
+
+		os.Mkdir(filepath.Join(dir, "d"), 0755)
+		for _, fn := range []string{"a", "d/e"} {
+			if err := ioutil.WriteFile(filepath.Join(dir, fn), []byte{}, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ioutil.WriteFile(filepath.Join(dir, uidgidFile), []byte("a:2:3\nd:3:3:2:0x20000000\n"), 0600)
+		ioutil.WriteFile(filepath.Join(dir, "d", uidgidFile), []byte("e:4:4\n"), 0600)
+
+		xattrs, _ := NewXattrStore()
+		n, err := CopyMeta(dir, NewUidGidStore(), xattrs)
+		if err != nil || n != 3 {
+			t.Fatalf("CopyMeta(uidgid, xattr) = %d, %v; expected 3\n", n, err)
+		}
+
+		m, found, err := xattrs.Get(filepath.Join(dir, "d"), nil)
+		if err != nil || !found || !reflect.DeepEqual(m, Meta{Uid: 3, Gid: 3, Muid: 2, Mode: 0x20000000}) {
+			t.Errorf("Meta of d in xattrs: %v, %v, %v\n", m, found, err)
+		}
+
+		// And back again.
+		os.Remove(filepath.Join(dir, uidgidFile))
+		os.Remove(filepath.Join(dir, "d", uidgidFile))
+		n, err = CopyMeta(dir, xattrs, NewUidGidStore())
+		if err != nil || n != 3 {
+			t.Fatalf("CopyMeta(xattr, uidgid) = %d, %v; expected 3\n", n, err)
+		}
+		data, _ := ioutil.ReadFile(filepath.Join(dir, uidgidFile))
+		if string(data) != "a:2:3\nd:3:3:2:0x20000000\n" {
+			t.Errorf("%s after converting back:\n%s\n", uidgidFile, data)
+		}
+	})
+}